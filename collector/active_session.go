@@ -26,10 +26,9 @@ var (
 		"wait_type",
 		"text",
 	}
-	dbActiveSessionDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "session", "active"),
+	dbActiveSessionDesc = newDesc("session", "active",
 		"MSSQL Database Space Info",
-		dbActiveSessionCols, nil)
+		dbActiveSessionCols)
 
 	dbBlockedSessionCols = []string{
 		"blocking_session_id",
@@ -44,12 +43,45 @@ var (
 		"blocked_db_name",
 		"wait_type",
 	}
-	dbBlockedSessionDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "session", "blocked"),
+	dbBlockedSessionDesc = newDesc("session", "blocked",
 		"MSSQL Database Space Info",
-		dbBlockedSessionCols, nil)
+		dbBlockedSessionCols)
 )
 
+type activeSessionRow struct {
+	SessionID                 int64  `db:"session_id"`
+	ClientNetAddress          string `db:"client_net_address,nullable"`
+	ClientTCPPort             int64  `db:"client_tcp_port,nullable"`
+	LoginTime                 string `db:"login_time,nullable"`
+	LoginName                 string `db:"login_name,nullable"`
+	HostName                  string `db:"host_name,nullable"`
+	ProgramName               string `db:"program_name,nullable"`
+	Status                    string `db:"status,nullable"`
+	OpenTransactionCount      int64  `db:"open_transaction_count,nullable"`
+	TransactionIsolationLevel int64  `db:"transaction_isolation_level,nullable"`
+	StartTime                 string `db:"start_time,nullable"`
+	Command                   string `db:"command,nullable"`
+	RequestStatus             string `db:"request_status,nullable"`
+	WaitType                  string `db:"wait_type,nullable"`
+	Text                      string `db:"text,nullable"`
+	TotalElapsedTime          int64  `db:"total_elapsed_time,nullable"`
+}
+
+type blockedSessionRow struct {
+	BlockingSessionID   int64  `db:"blockingsessionid,nullable"`
+	BlockingUser        string `db:"blockinguser,nullable"`
+	BlockingLoginTime   string `db:"login_time,nullable"`
+	BlockingHostName    string `db:"host_name,nullable"`
+	BlockingProgramName string `db:"program_name,nullable"`
+	BlockingSQL         string `db:"blockingsql,nullable"`
+	BlockedSessionID    int64  `db:"blockedsessionid,nullable"`
+	BlockedUser         string `db:"blockeduser,nullable"`
+	BlockedSQL          string `db:"blockedsql,nullable"`
+	DatabaseName        string `db:"databasename,nullable"`
+	WhyBlocked          string `db:"whyblocked,nullable"`
+	WaitDurationMs      int64  `db:"wait_duration_ms,nullable"`
+}
+
 type ScrapeDbSession struct {
 	lastTime time.Time
 }
@@ -64,7 +96,7 @@ func (ScrapeDbSession) Help() string {
 }
 
 func (ScrapeDbSession) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeDbSession) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
@@ -109,28 +141,29 @@ and b.session_id > 50
 and b.status != 'sleeping'
 and s.text not like 'select /* mssql_exporter%'
 `
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []activeSessionRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
 		return err
 	}
 
 	for _, r := range rows {
-		ch <- prometheus.MustNewConstMetric(dbActiveSessionDesc, prometheus.GaugeValue, float64(r[15].(int64)),
-			formatInt64(r[0].(int64)),
-			r[1].(string),
-			formatInt64(r[2].(int64)),
-			formatNullableTime(r[3]),
-			r[4].(string),
-			r[5].(string),
-			r[6].(string),
-			r[7].(string),
-			formatInt64(r[8].(int64)),
-			formatInt64(r[9].(int64)),
-			formatNullableTime(r[10]),
-			r[11].(string),
-			r[12].(string),
-			formatNullableString(r[13]),
-			r[14].(string),
+		ch <- prometheus.MustNewConstMetric(dbActiveSessionDesc, prometheus.GaugeValue, float64(r.TotalElapsedTime),
+			formatInt64(r.SessionID),
+			r.ClientNetAddress,
+			formatInt64(r.ClientTCPPort),
+			r.LoginTime,
+			r.LoginName,
+			r.HostName,
+			r.ProgramName,
+			r.Status,
+			formatInt64(r.OpenTransactionCount),
+			formatInt64(r.TransactionIsolationLevel),
+			r.StartTime,
+			r.Command,
+			r.RequestStatus,
+			r.WaitType,
+			r.Text,
 		)
 	}
 	return nil
@@ -157,24 +190,25 @@ FROM sys.dm_exec_connections AS Blocking
 	CROSS APPLY sys.dm_exec_sql_text(Blocking.most_recent_sql_handle) AS BlockingSQL
 	CROSS APPLY sys.dm_exec_sql_text(Blocked.sql_handle) AS BlockedSQL
 `
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []blockedSessionRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
 		return err
 	}
 
 	for _, r := range rows {
-		ch <- prometheus.MustNewConstMetric(dbBlockedSessionDesc, prometheus.GaugeValue, float64(r[11].(int64)),
-			formatInt64(r[0].(int64)),
-			r[1].(string),
-			formatNullableTime(r[2]),
-			r[3].(string),
-			r[4].(string),
-			r[5].(string),
-			formatInt64(r[6].(int64)),
-			r[7].(string),
-			r[8].(string),
-			r[9].(string),
-			r[10].(string),
+		ch <- prometheus.MustNewConstMetric(dbBlockedSessionDesc, prometheus.GaugeValue, float64(r.WaitDurationMs),
+			formatInt64(r.BlockingSessionID),
+			r.BlockingUser,
+			r.BlockingLoginTime,
+			r.BlockingHostName,
+			r.BlockingProgramName,
+			r.BlockingSQL,
+			formatInt64(r.BlockedSessionID),
+			r.BlockedUser,
+			r.BlockedSQL,
+			r.DatabaseName,
+			r.WhyBlocked,
 		)
 	}
 	return nil
@@ -0,0 +1,219 @@
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	agentJobLabels = []string{"job"}
+
+	agentServiceRunningDesc = newDesc("agent", "service_running",
+		"Whether the SQL Server Agent service is running.",
+		[]string{"startup_type"})
+
+	agentJobEnabledDesc = newDesc("agent", "job_enabled",
+		"Whether the Agent job is enabled.",
+		agentJobLabels)
+
+	agentJobLastRunOutcomeDesc = newDesc("agent", "job_last_run_outcome",
+		"Outcome of the last run of the Agent job (0 failed, 1 succeeded, 2 retry, 3 canceled, 4 in progress).",
+		agentJobLabels)
+
+	agentJobLastRunDesc = newDesc("agent", "job_last_run_timestamp_seconds",
+		"Time the last run of the Agent job started.",
+		agentJobLabels)
+
+	agentJobLastDurationDesc = newDesc("agent", "job_last_run_duration_seconds",
+		"Duration of the last run of the Agent job.",
+		agentJobLabels)
+
+	agentJobLastSuccessDesc = newDesc("agent", "job_last_success_timestamp_seconds",
+		"Time the last successful run of the Agent job started.",
+		agentJobLabels)
+
+	agentJobNextRunDesc = newDesc("agent", "job_next_run_timestamp_seconds",
+		"Next scheduled run of the Agent job, not reported for jobs without an enabled schedule.",
+		agentJobLabels)
+
+	agentJobRunningDesc = newDesc("agent", "job_running",
+		"Whether the Agent job is running.",
+		agentJobLabels)
+
+	agentJobRunningSecondsDesc = newDesc("agent", "job_running_seconds",
+		"Seconds since the running Agent job started.",
+		agentJobLabels)
+
+	agentJobConsecutiveFailuresDesc = newDesc("agent", "job_consecutive_failures",
+		"Number of failed runs of the Agent job since its last successful run.",
+		agentJobLabels)
+
+	intervalAgentJob = 30 * time.Second
+)
+
+type agentServiceRow struct {
+	Status      int64  `db:"status"`
+	StartupType string `db:"startup_type_desc,nullable"`
+}
+
+// agentJobRow is the state of an Agent job, times are in seconds before the current
+// time of the server since msdb keeps them in server local time.
+type agentJobRow struct {
+	JobName             string   `db:"job_name"`
+	Enabled             bool     `db:"enabled"`
+	ServerEpoch         float64  `db:"server_epoch"`
+	LastRunStatus       *int64   `db:"last_run_status"`
+	LastRunAge          *float64 `db:"last_run_age_seconds"`
+	LastRunDuration     *float64 `db:"last_run_duration_seconds"`
+	LastSuccessAge      *float64 `db:"last_success_age_seconds"`
+	NextRunAge          *float64 `db:"next_run_age_seconds"`
+	RunningSeconds      *float64 `db:"running_seconds"`
+	ConsecutiveFailures float64  `db:"consecutive_failures"`
+}
+
+// ScrapeAgentJob collects the SQL Server Agent service status and the state of every Agent job.
+type ScrapeAgentJob struct{}
+
+func (ScrapeAgentJob) Name() string {
+	return "mssql_agent_job"
+}
+
+func (ScrapeAgentJob) Help() string {
+	return "collect SQL Server Agent service status and job runs from msdb"
+}
+
+func (ScrapeAgentJob) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeAgentJob) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// sys.dm_server_services is available from 2008R2 SP1
+	if ins.ServerVersion.AtLeastBuild(10, 50, 2500) {
+		err := s.scrapeService(ctx, dbcli, ch)
+		if err != nil {
+			return err
+		}
+	}
+	return s.scrapeJobs(ctx, dbcli, ch)
+}
+
+func (s *ScrapeAgentJob) scrapeService(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// editions without Agent have no row
+	sql := `SELECT status, startup_type_desc FROM sys.dm_server_services WHERE servicename LIKE 'SQL Server Agent%'`
+	var rows []agentServiceRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		running := 0.0
+		// 4 is running
+		if r.Status == 4 {
+			running = 1
+		}
+		ch <- prometheus.MustNewConstMetric(agentServiceRunningDesc, prometheus.GaugeValue, running, r.StartupType)
+	}
+	return nil
+}
+
+func (s *ScrapeAgentJob) scrapeJobs(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// step 0 of sysjobhistory is the outcome of the whole job run, dates and times are
+	// integers like 20230131 and 235959, durations like 235959 as well; running jobs
+	// are those started but not stopped in the current Agent session
+	sql := `WITH runs AS (
+  SELECT h.instance_id, h.job_id, h.run_status,
+    DATEADD(second, h.run_time / 10000 * 3600 + h.run_time / 100 % 100 * 60 + h.run_time % 100,
+      CONVERT(datetime, CAST(h.run_date AS char(8)), 112)) AS run_start,
+    h.run_duration / 10000 * 3600 + h.run_duration / 100 % 100 * 60 + h.run_duration % 100 AS run_duration,
+    ROW_NUMBER() OVER (PARTITION BY h.job_id ORDER BY h.instance_id DESC) AS rn
+  FROM msdb.dbo.sysjobhistory h
+  WHERE h.step_id = 0
+),
+last_success AS (
+  SELECT job_id, MAX(instance_id) AS instance_id, MAX(run_start) AS run_start
+  FROM runs
+  WHERE run_status = 1
+  GROUP BY job_id
+),
+failures AS (
+  SELECT r.job_id, COUNT(*) AS consecutive_failures
+  FROM runs r
+  LEFT JOIN last_success ls ON ls.job_id = r.job_id
+  WHERE r.run_status = 0 AND r.instance_id > ISNULL(ls.instance_id, 0)
+  GROUP BY r.job_id
+),
+next_run AS (
+  SELECT js.job_id,
+    MIN(DATEADD(second, js.next_run_time / 10000 * 3600 + js.next_run_time / 100 % 100 * 60 + js.next_run_time % 100,
+      CONVERT(datetime, CAST(js.next_run_date AS char(8)), 112))) AS next_run
+  FROM msdb.dbo.sysjobschedules js
+  JOIN msdb.dbo.sysschedules sc ON sc.schedule_id = js.schedule_id
+  WHERE js.next_run_date > 0 AND sc.enabled = 1
+  GROUP BY js.job_id
+),
+running AS (
+  SELECT ja.job_id, MAX(ja.start_execution_date) AS start_execution_date
+  FROM msdb.dbo.sysjobactivity ja
+  WHERE ja.session_id = (SELECT MAX(session_id) FROM msdb.dbo.syssessions)
+    AND ja.start_execution_date IS NOT NULL AND ja.stop_execution_date IS NULL
+  GROUP BY ja.job_id
+)
+SELECT j.name AS job_name, j.enabled,
+  DATEDIFF(second, '19700101', GETUTCDATE()) AS server_epoch,
+  lr.run_status AS last_run_status,
+  DATEDIFF(second, lr.run_start, GETDATE()) AS last_run_age_seconds,
+  lr.run_duration AS last_run_duration_seconds,
+  DATEDIFF(second, ls.run_start, GETDATE()) AS last_success_age_seconds,
+  DATEDIFF(second, nr.next_run, GETDATE()) AS next_run_age_seconds,
+  DATEDIFF(second, ru.start_execution_date, GETDATE()) AS running_seconds,
+  ISNULL(f.consecutive_failures, 0) AS consecutive_failures
+FROM msdb.dbo.sysjobs j
+LEFT JOIN runs lr ON lr.job_id = j.job_id AND lr.rn = 1
+LEFT JOIN last_success ls ON ls.job_id = j.job_id
+LEFT JOIN failures f ON f.job_id = j.job_id
+LEFT JOIN next_run nr ON nr.job_id = j.job_id
+LEFT JOIN running ru ON ru.job_id = j.job_id
+`
+	var rows []agentJobRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		enabled := 0.0
+		if r.Enabled {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(agentJobEnabledDesc, prometheus.GaugeValue, enabled, r.JobName)
+		ch <- prometheus.MustNewConstMetric(agentJobConsecutiveFailuresDesc, prometheus.GaugeValue, r.ConsecutiveFailures, r.JobName)
+
+		if r.LastRunStatus != nil {
+			ch <- prometheus.MustNewConstMetric(agentJobLastRunOutcomeDesc, prometheus.GaugeValue, float64(*r.LastRunStatus), r.JobName)
+		}
+		if r.LastRunAge != nil {
+			ch <- prometheus.MustNewConstMetric(agentJobLastRunDesc, prometheus.GaugeValue, r.ServerEpoch-*r.LastRunAge, r.JobName)
+		}
+		if r.LastRunDuration != nil {
+			ch <- prometheus.MustNewConstMetric(agentJobLastDurationDesc, prometheus.GaugeValue, *r.LastRunDuration, r.JobName)
+		}
+		if r.LastSuccessAge != nil {
+			ch <- prometheus.MustNewConstMetric(agentJobLastSuccessDesc, prometheus.GaugeValue, r.ServerEpoch-*r.LastSuccessAge, r.JobName)
+		}
+		if r.NextRunAge != nil {
+			ch <- prometheus.MustNewConstMetric(agentJobNextRunDesc, prometheus.GaugeValue, r.ServerEpoch-*r.NextRunAge, r.JobName)
+		}
+
+		if r.RunningSeconds != nil {
+			ch <- prometheus.MustNewConstMetric(agentJobRunningDesc, prometheus.GaugeValue, 1, r.JobName)
+			ch <- prometheus.MustNewConstMetric(agentJobRunningSecondsDesc, prometheus.GaugeValue, nonNegativeFloat(*r.RunningSeconds), r.JobName)
+		} else {
+			ch <- prometheus.MustNewConstMetric(agentJobRunningDesc, prometheus.GaugeValue, 0, r.JobName)
+		}
+	}
+	return nil
+}
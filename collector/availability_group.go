@@ -0,0 +1,217 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	skipReasonHadrDisabled = "hadr_disabled"
+)
+
+var (
+	agReplicaLabels  = []string{"availability_group", "replica"}
+	agDatabaseLabels = []string{"availability_group", "replica", "database"}
+
+	agReplicaInfoDesc = newDesc("ag", "replica_info",
+		"Availability replica configuration, is_local is 1 for the replica of this instance.",
+		[]string{"availability_group", "replica", "availability_mode", "failover_mode", "is_local"})
+
+	agReplicaRoleDesc = newDesc("ag", "replica_role",
+		"Role of the availability replica (0 resolving, 1 primary, 2 secondary).",
+		agReplicaLabels)
+
+	agReplicaConnectedDesc = newDesc("ag", "replica_connected",
+		"Whether the secondary replica is connected to the primary replica.",
+		agReplicaLabels)
+
+	agReplicaSyncHealthDesc = newDesc("ag", "replica_synchronization_health",
+		"Synchronization health of the availability replica (0 not healthy, 1 partially healthy, 2 healthy).",
+		agReplicaLabels)
+
+	agDatabaseSyncStateDesc = newDesc("ag", "database_synchronization_state",
+		"Synchronization state of the database replica (0 not synchronizing, 1 synchronizing, 2 synchronized, 3 reverting, 4 initializing).",
+		agDatabaseLabels)
+
+	agDatabaseSyncHealthDesc = newDesc("ag", "database_synchronization_health",
+		"Synchronization health of the database replica (0 not healthy, 1 partially healthy, 2 healthy).",
+		agDatabaseLabels)
+
+	agDatabaseSuspendedDesc = newDesc("ag", "database_suspended",
+		"Whether data movement of the database replica is suspended.",
+		agDatabaseLabels)
+
+	agLogSendQueueDesc = newDesc("ag", "database_log_send_queue_bytes",
+		"Log of the primary database not yet sent to the secondary database.",
+		agDatabaseLabels)
+
+	agLogSendRateDesc = newDesc("ag", "database_log_send_rate_bytes",
+		"Average rate log is sent to the secondary database, in bytes per second.",
+		agDatabaseLabels)
+
+	agRedoQueueDesc = newDesc("ag", "database_redo_queue_bytes",
+		"Log received by the secondary database not yet redone.",
+		agDatabaseLabels)
+
+	agRedoRateDesc = newDesc("ag", "database_redo_rate_bytes",
+		"Average rate log is redone on the secondary database, in bytes per second.",
+		agDatabaseLabels)
+
+	agDataLossDesc = newDesc("ag", "database_estimated_data_loss_seconds",
+		"Commit time lag of the secondary database behind the primary database, only reported on the primary replica.",
+		agDatabaseLabels)
+
+	agRecoveryTimeDesc = newDesc("ag", "database_estimated_recovery_time_seconds",
+		"Time for the secondary database to redo its redo queue at the current redo rate.",
+		agDatabaseLabels)
+)
+
+type agReplicaRow struct {
+	AgName                string `db:"ag_name"`
+	ReplicaName           string `db:"replica_server_name"`
+	AvailabilityMode      string `db:"availability_mode_desc,nullable"`
+	FailoverMode          string `db:"failover_mode_desc,nullable"`
+	IsLocal               *bool  `db:"is_local"`
+	Role                  *int64 `db:"role"`
+	ConnectedState        *int64 `db:"connected_state"`
+	SynchronizationHealth *int64 `db:"synchronization_health"`
+}
+
+type agDatabaseRow struct {
+	AgName                string   `db:"ag_name"`
+	ReplicaName           string   `db:"replica_server_name"`
+	DatabaseName          string   `db:"database_name"`
+	SynchronizationState  int64    `db:"synchronization_state,nullable"`
+	SynchronizationHealth int64    `db:"synchronization_health,nullable"`
+	IsSuspended           bool     `db:"is_suspended,nullable"`
+	LogSendQueueSize      *float64 `db:"log_send_queue_size"`
+	LogSendRate           *float64 `db:"log_send_rate"`
+	RedoQueueSize         *float64 `db:"redo_queue_size"`
+	RedoRate              *float64 `db:"redo_rate"`
+	DataLossSeconds       *float64 `db:"data_loss_seconds"`
+}
+
+// ScrapeAvailabilityGroup collects the state of the Always On availability groups of the instance.
+type ScrapeAvailabilityGroup struct{}
+
+func (ScrapeAvailabilityGroup) Name() string {
+	return "mssql_availability_group"
+}
+
+func (ScrapeAvailabilityGroup) Help() string {
+	return "collect Always On availability group replica and database states"
+}
+
+func (ScrapeAvailabilityGroup) Version() float64 {
+	return 11.0
+}
+
+func (s *ScrapeAvailabilityGroup) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	if ins.IsHadrEnabled != 1 {
+		return &SkipError{Reason: skipReasonHadrDisabled}
+	}
+
+	err := s.scrapeReplicas(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+	return s.scrapeDatabases(ctx, dbcli, ch)
+}
+
+func (s *ScrapeAvailabilityGroup) scrapeReplicas(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// a secondary replica only knows the state of its own replica
+	sql := `SELECT ag.name AS ag_name, ar.replica_server_name,
+  ar.availability_mode_desc, ar.failover_mode_desc,
+  ars.is_local, ars.role, ars.connected_state, ars.synchronization_health
+FROM sys.availability_replicas ar
+JOIN sys.availability_groups ag ON ag.group_id = ar.group_id
+LEFT JOIN sys.dm_hadr_availability_replica_states ars ON ars.replica_id = ar.replica_id
+`
+	var rows []agReplicaRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		isLocal := "0"
+		if r.IsLocal != nil && *r.IsLocal {
+			isLocal = "1"
+		}
+		ch <- prometheus.MustNewConstMetric(agReplicaInfoDesc, prometheus.GaugeValue, 1,
+			r.AgName, r.ReplicaName, r.AvailabilityMode, r.FailoverMode, isLocal)
+
+		if r.Role == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(agReplicaRoleDesc, prometheus.GaugeValue, float64(*r.Role), r.AgName, r.ReplicaName)
+		if r.ConnectedState != nil {
+			ch <- prometheus.MustNewConstMetric(agReplicaConnectedDesc, prometheus.GaugeValue, float64(*r.ConnectedState),
+				r.AgName, r.ReplicaName)
+		}
+		if r.SynchronizationHealth != nil {
+			ch <- prometheus.MustNewConstMetric(agReplicaSyncHealthDesc, prometheus.GaugeValue, float64(*r.SynchronizationHealth),
+				r.AgName, r.ReplicaName)
+		}
+	}
+	return nil
+}
+
+func (s *ScrapeAvailabilityGroup) scrapeDatabases(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// the data loss is the commit time lag behind the primary database, which is only
+	// known on the primary replica; sizes and rates are in KB
+	sql := `SELECT ag.name AS ag_name, ar.replica_server_name, adc.database_name,
+  drs.synchronization_state, drs.synchronization_health, drs.is_suspended,
+  drs.log_send_queue_size, drs.log_send_rate, drs.redo_queue_size, drs.redo_rate,
+  DATEDIFF(second, drs.last_commit_time, pdrs.last_commit_time) AS data_loss_seconds
+FROM sys.dm_hadr_database_replica_states drs
+JOIN sys.availability_replicas ar ON ar.replica_id = drs.replica_id
+JOIN sys.availability_groups ag ON ag.group_id = drs.group_id
+JOIN sys.availability_databases_cluster adc ON adc.group_database_id = drs.group_database_id
+LEFT JOIN (sys.dm_hadr_database_replica_states pdrs
+  JOIN sys.dm_hadr_availability_replica_states pars ON pars.replica_id = pdrs.replica_id AND pars.role = 1)
+  ON pdrs.group_database_id = drs.group_database_id AND pdrs.replica_id <> drs.replica_id
+`
+	var rows []agDatabaseRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		labels := []string{r.AgName, r.ReplicaName, r.DatabaseName}
+		ch <- prometheus.MustNewConstMetric(agDatabaseSyncStateDesc, prometheus.GaugeValue, float64(r.SynchronizationState), labels...)
+		ch <- prometheus.MustNewConstMetric(agDatabaseSyncHealthDesc, prometheus.GaugeValue, float64(r.SynchronizationHealth), labels...)
+
+		suspended := 0.0
+		if r.IsSuspended {
+			suspended = 1
+		}
+		ch <- prometheus.MustNewConstMetric(agDatabaseSuspendedDesc, prometheus.GaugeValue, suspended, labels...)
+
+		if r.LogSendQueueSize != nil {
+			ch <- prometheus.MustNewConstMetric(agLogSendQueueDesc, prometheus.GaugeValue, *r.LogSendQueueSize*1024, labels...)
+		}
+		if r.LogSendRate != nil {
+			ch <- prometheus.MustNewConstMetric(agLogSendRateDesc, prometheus.GaugeValue, *r.LogSendRate*1024, labels...)
+		}
+		if r.RedoQueueSize != nil {
+			ch <- prometheus.MustNewConstMetric(agRedoQueueDesc, prometheus.GaugeValue, *r.RedoQueueSize*1024, labels...)
+		}
+		if r.RedoRate != nil {
+			ch <- prometheus.MustNewConstMetric(agRedoRateDesc, prometheus.GaugeValue, *r.RedoRate*1024, labels...)
+		}
+		if r.DataLossSeconds != nil {
+			ch <- prometheus.MustNewConstMetric(agDataLossDesc, prometheus.GaugeValue, nonNegativeFloat(*r.DataLossSeconds), labels...)
+		}
+
+		if r.RedoQueueSize != nil && *r.RedoQueueSize == 0 {
+			ch <- prometheus.MustNewConstMetric(agRecoveryTimeDesc, prometheus.GaugeValue, 0, labels...)
+		} else if r.RedoQueueSize != nil && r.RedoRate != nil && *r.RedoRate > 0 {
+			ch <- prometheus.MustNewConstMetric(agRecoveryTimeDesc, prometheus.GaugeValue, *r.RedoQueueSize / *r.RedoRate, labels...)
+		}
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package collector
 
 import (
 	"context"
-	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -10,90 +9,136 @@ import (
 )
 
 var (
-	dbBackupColumns = []string{"backup_set_id", "backup_set_uuid", "expiration_date", "name", "user_name",
-		"first_lsn", "last_lsn", "checkpoint_lsn", "database_backup_lsn", "database_creation_date",
-		"backup_start_date", "backup_finish_date", "type", "database_name", "server_name",
-		"machine_name", "recovery_model", "is_damaged", "differential_base_lsn", "differential_base_guid"}
+	dbBackupLabels = []string{"database", "type"}
 
-	dbBackupDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "database", "backup"),
-		"MSSQL Database Space Info",
-		dbBackupColumns, nil)
+	dbBackupExistsDesc = newDesc("db_backup", "exists",
+		"Whether the database has a backup of the type (1 for yes, 0 for never backed up).",
+		dbBackupLabels)
+
+	dbBackupLastFinishDesc = newDesc("db_backup", "last_finish_timestamp_seconds",
+		"Time the last backup of the type finished.",
+		dbBackupLabels)
+
+	dbBackupAgeDesc = newDesc("db_backup", "age_seconds",
+		"Seconds since the last backup of the type finished.",
+		dbBackupLabels)
+
+	dbBackupDurationDesc = newDesc("db_backup", "last_duration_seconds",
+		"Duration of the last backup of the type.",
+		dbBackupLabels)
+
+	dbBackupSizeDesc = newDesc("db_backup", "last_size_bytes",
+		"Size of the last backup of the type.",
+		dbBackupLabels)
+
+	dbBackupCompressedSizeDesc = newDesc("db_backup", "last_compressed_size_bytes",
+		"Compressed size of the last backup of the type.",
+		dbBackupLabels)
+
+	dbBackupLogMissingDesc = newDesc("db_backup", "log_backup_missing",
+		"Whether the database is in FULL or BULK_LOGGED recovery and has never had a log backup.",
+		[]string{"database", "recovery_model"})
+
+	// dbBackupTypes maps the backupset types to the type label
+	dbBackupTypes = map[string]string{
+		"D": "full",
+		"I": "diff",
+		"L": "log",
+	}
 
 	intervalDbBackup = 30 * time.Second
 )
 
-type ScrapeDbBackup struct {
-	lastTime time.Time
+// dbBackupRow is the last backup of a type of a database, the backup columns are NULL
+// when the database never had a backup of the type.
+type dbBackupRow struct {
+	DatabaseName         string   `db:"database_name"`
+	RecoveryModel        string   `db:"recovery_model_desc,nullable"`
+	Type                 string   `db:"type"`
+	ServerEpoch          float64  `db:"server_epoch"`
+	AgeSeconds           *float64 `db:"age_seconds"`
+	DurationSeconds      *float64 `db:"duration_seconds"`
+	BackupSize           *float64 `db:"backup_size"`
+	CompressedBackupSize *float64 `db:"compressed_backup_size"`
 }
 
+type ScrapeDbBackup struct{}
+
 func (ScrapeDbBackup) Name() string {
 	return "mssql_db_backup"
 }
 
 func (ScrapeDbBackup) Help() string {
-	return "collect stats from msdb.dbo.backupset"
+	return "collect the last backup of every database and backup type from msdb.dbo.backupset"
 }
 
 func (ScrapeDbBackup) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeDbBackup) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
-	duration := time.Since(s.lastTime)
-	if duration < intervalDbSpace {
-		return nil
-	}
-
-	sql := `select backup_set_id, backup_set_uuid, expiration_date, name,  user_name, 
-	first_lsn, last_lsn, checkpoint_lsn, database_backup_lsn, database_creation_date, 
-	backup_start_date, backup_finish_date, type, database_name, server_name, 
-	machine_name, recovery_model, is_damaged, differential_base_lsn, differential_base_guid, 
-	backup_size, compressed_backup_size
-from msdb.dbo.backupset
-where backup_finish_date >= dateadd(minute, -1440000, GETDATE())
+	// backups of a dropped database with the same name are told apart by the creation date,
+	// tempdb and database snapshots can not be backed up
+	sql := `WITH last_backup AS (
+  SELECT bs.database_name, bs.database_creation_date, bs.type,
+    bs.backup_start_date, bs.backup_finish_date, bs.backup_size, bs.compressed_backup_size,
+    ROW_NUMBER() OVER (PARTITION BY bs.database_name, bs.database_creation_date, bs.type
+      ORDER BY bs.backup_finish_date DESC) AS rn
+  FROM msdb.dbo.backupset bs
+  WHERE bs.type IN ('D', 'I', 'L') AND bs.backup_finish_date IS NOT NULL
+)
+SELECT d.name AS database_name, d.recovery_model_desc, t.type,
+  DATEDIFF(second, '19700101', GETUTCDATE()) AS server_epoch,
+  DATEDIFF(second, b.backup_finish_date, GETDATE()) AS age_seconds,
+  DATEDIFF(second, b.backup_start_date, b.backup_finish_date) AS duration_seconds,
+  b.backup_size, b.compressed_backup_size
+FROM sys.databases d
+CROSS JOIN (VALUES ('D'), ('I'), ('L')) AS t(type)
+LEFT JOIN last_backup b ON b.database_name = d.name AND b.database_creation_date = d.create_date
+  AND b.type = t.type AND b.rn = 1
+WHERE d.name <> 'tempdb' AND d.source_database_id IS NULL
 `
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []dbBackupRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	currentTime := time.Now()
-
 	for _, r := range rows {
-
-		backupSize, err := strconv.ParseFloat(formatNullableByteArray(r[20]), 64)
-		if err != nil {
-			return err
+		backupType := dbBackupTypes[r.Type]
+
+		if r.Type == "L" {
+			missing := 0.0
+			if r.AgeSeconds == nil && (r.RecoveryModel == "FULL" || r.RecoveryModel == "BULK_LOGGED") {
+				missing = 1
+			}
+			ch <- prometheus.MustNewConstMetric(dbBackupLogMissingDesc, prometheus.GaugeValue, missing,
+				r.DatabaseName, r.RecoveryModel)
 		}
 
-		ch <- prometheus.MustNewConstMetric(
-			dbBackupDesc, prometheus.GaugeValue, backupSize,
-			formatInt64(r[0].(int64)),
-			formatNullableByteArray(r[1]),
-			formatNullableTime(r[2]),
-			formatNullableString(r[3]),
-			formatNullableString(r[4]),
-			formatNullableByteArray(r[5]),
-			formatNullableByteArray(r[6]),
-			formatNullableByteArray(r[7]),
-			formatNullableByteArray(r[8]),
-			formatTime(r[9].(time.Time)),
-			formatTime(r[10].(time.Time)),
-			formatTime(r[11].(time.Time)),
-			formatNullableString(r[12]),
-			formatNullableString(r[13]),
-			formatNullableString(r[14]),
-			formatNullableString(r[15]),
-			formatNullableString(r[16]),
-			formatBool(r[17].(bool)),
-			formatNullableByteArray(r[18]),
-			formatNullableByteArray(r[19]),
-		)
+		if r.AgeSeconds == nil {
+			ch <- prometheus.MustNewConstMetric(dbBackupExistsDesc, prometheus.GaugeValue, 0, r.DatabaseName, backupType)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(dbBackupExistsDesc, prometheus.GaugeValue, 1, r.DatabaseName, backupType)
+
+		ch <- prometheus.MustNewConstMetric(dbBackupAgeDesc, prometheus.GaugeValue, *r.AgeSeconds, r.DatabaseName, backupType)
+		ch <- prometheus.MustNewConstMetric(dbBackupLastFinishDesc, prometheus.GaugeValue,
+			r.ServerEpoch-*r.AgeSeconds, r.DatabaseName, backupType)
+		if r.DurationSeconds != nil {
+			ch <- prometheus.MustNewConstMetric(dbBackupDurationDesc, prometheus.GaugeValue, *r.DurationSeconds,
+				r.DatabaseName, backupType)
+		}
+		if r.BackupSize != nil {
+			ch <- prometheus.MustNewConstMetric(dbBackupSizeDesc, prometheus.GaugeValue, *r.BackupSize,
+				r.DatabaseName, backupType)
+		}
+		if r.CompressedBackupSize != nil {
+			ch <- prometheus.MustNewConstMetric(dbBackupCompressedSizeDesc, prometheus.GaugeValue, *r.CompressedBackupSize,
+				r.DatabaseName, backupType)
+		}
 	}
 
-	s.lastTime = currentTime
-
 	return nil
 }
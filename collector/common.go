@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"regexp"
@@ -10,9 +11,39 @@ import (
 
 	"io/ioutil"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
 )
 
+// skippedRowsKey is the context key of the skipped rows counter of the running scraper.
+type skippedRowsKey struct{}
+
+// selectRows maps the rows of the query onto dest, a pointer to a slice of structs, with dbcli.Select.
+// Rows which can not be mapped are skipped and counted on the scraper running the query.
+func selectRows(ctx context.Context, dbcli *dbutil.MSSQLClient, dest interface{}, query string, params ...interface{}) error {
+	skipped, err := dbcli.Select(ctx, dest, query, params...)
+	if counter, ok := ctx.Value(skippedRowsKey{}).(prometheus.Counter); ok && skipped > 0 {
+		counter.Add(float64(skipped))
+	}
+	return err
+}
+
+// builtinSubsystems are the subsystems of the built-in metrics, recorded by builtinSubsystem
+// while the package is initialized. Custom query metrics may not use them.
+var builtinSubsystems = make(map[string]bool)
+
+// builtinSubsystem records subsystem as used by built-in metrics and returns it.
+func builtinSubsystem(subsystem string) string {
+	builtinSubsystems[subsystem] = true
+	return subsystem
+}
+
+// newDesc returns the descriptor of a built-in metric, it may only be called during package initialization.
+func newDesc(subsystem, name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, builtinSubsystem(subsystem), name), help, labels, nil)
+}
+
 var (
 	labelRemovePattern = regexp.MustCompile(`[:()*/%<>=&-]`)
 	labelRemoveDup     = regexp.MustCompile("  +")
@@ -96,25 +127,36 @@ func formatBool(v bool) string {
 	return "no"
 }
 
-func formatNullableTime(v interface{}) string {
-	if v == nil {
-		return ""
+func boolToFloat(v bool) float64 {
+	if v {
+		return 1
 	}
-
-	return formatTime(v.(time.Time))
+	return 0
 }
 
-func formatNullableByteArray(v interface{}) string {
-	if v == nil {
-		return ""
+func nonNegativeFloat(v float64) float64 {
+	if v < 0 {
+		return 0
 	}
-
-	return formatUint8Array(v.([]uint8))
+	return v
 }
 
-func formatNullableString(v interface{}) string {
-	if v == nil {
-		return ""
+// sendStateSet sends 1 for the current state and 0 for the other states, a current state
+// not in states is sent as well.
+func sendStateSet(ch chan<- prometheus.Metric, desc *prometheus.Desc, states []string, current string, labels ...string) {
+	labels = append(labels[:len(labels):len(labels)], "")
+	known := false
+	for _, state := range states {
+		v := 0.0
+		if state == current {
+			v = 1
+			known = true
+		}
+		labels[len(labels)-1] = state
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+	if !known && current != "" {
+		labels[len(labels)-1] = current
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, labels...)
 	}
-	return v.(string)
 }
@@ -0,0 +1,186 @@
+package collector
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	cpuSQLProcessDesc = newDesc("cpu", "sql_process_percent",
+		"CPU utilization of the SQL Server process in the last scheduler monitor record.",
+		nil)
+
+	cpuSystemIdleDesc = newDesc("cpu", "system_idle_percent",
+		"Idle CPU of the system in the last scheduler monitor record.",
+		nil)
+
+	cpuOtherProcessDesc = newDesc("cpu", "other_process_percent",
+		"CPU utilization of the other processes of the system in the last scheduler monitor record.",
+		nil)
+
+	cpuSQLProcessMaxDesc = newDesc("cpu", "sql_process_max_percent",
+		"Highest CPU utilization of the SQL Server process in the scheduler monitor records read by the last scrape with new records.",
+		nil)
+
+	cpuOtherProcessMaxDesc = newDesc("cpu", "other_process_max_percent",
+		"Highest CPU utilization of the other processes in the scheduler monitor records read by the last scrape with new records.",
+		nil)
+
+	cpuRecordTimeDesc = newDesc("cpu", "record_timestamp_seconds",
+		"Time of the last scheduler monitor record.",
+		nil)
+
+	schedulerLabels = []string{"scheduler", "cpu", "node"}
+
+	schedulerCurrentTasksDesc = newDesc("scheduler", "current_tasks",
+		"Number of tasks associated with the scheduler.",
+		schedulerLabels)
+
+	schedulerRunnableTasksDesc = newDesc("scheduler", "runnable_tasks",
+		"Number of tasks waiting on the runnable queue of the scheduler.",
+		schedulerLabels)
+
+	schedulerWorkQueueDesc = newDesc("scheduler", "work_queue",
+		"Number of tasks waiting for a worker on the scheduler.",
+		schedulerLabels)
+
+	schedulerPendingIODesc = newDesc("scheduler", "pending_disk_io",
+		"Number of pending IOs of the scheduler.",
+		schedulerLabels)
+)
+
+type cpuRecordRow struct {
+	RecordID   int64   `db:"record_id"`
+	MsAgo      float64 `db:"ms_ago"`
+	SQLCPU     float64 `db:"sql_cpu"`
+	SystemIdle float64 `db:"system_idle"`
+}
+
+type schedulerRow struct {
+	SchedulerID   int64   `db:"scheduler_id"`
+	CPUID         int64   `db:"cpu_id"`
+	ParentNodeID  int64   `db:"parent_node_id"`
+	CurrentTasks  float64 `db:"current_tasks_count"`
+	RunnableTasks float64 `db:"runnable_tasks_count"`
+	WorkQueue     float64 `db:"work_queue_count"`
+	PendingDiskIO float64 `db:"pending_disk_io_count"`
+}
+
+// ScrapeCPU collects the CPU utilization of the scheduler monitor ring buffer and the load of the schedulers.
+// The ring buffer keeps a record a minute, only records newer than the last seen one are read.
+type ScrapeCPU struct {
+	mu         sync.Mutex
+	lastRecord *cpuRecordRow
+	lastTime   time.Time
+	// maxSQL and maxOther are the highest utilization in the records of the last read,
+	// a scrape interval may span several records
+	maxSQL   float64
+	maxOther float64
+}
+
+func (*ScrapeCPU) Name() string {
+	return "mssql_cpu"
+}
+
+func (*ScrapeCPU) Help() string {
+	return "collect CPU utilization from the scheduler monitor ring buffer and scheduler load from sys.dm_os_schedulers"
+}
+
+func (*ScrapeCPU) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeCPU) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	err := s.scrapeRingBuffer(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+	return s.scrapeSchedulers(ctx, dbcli, ch)
+}
+
+func (s *ScrapeCPU) scrapeRingBuffer(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lastID int64
+	if s.lastRecord != nil {
+		lastID = s.lastRecord.RecordID
+	}
+
+	// the first read only takes the newest record, the ring buffer keeps hours of records;
+	// record ids start over when the instance restarts, then every record is read again
+	sql := `WITH records AS (
+  SELECT rb.record.value('(./Record/@id)[1]', 'bigint') AS record_id,
+    si.ms_ticks - rb.timestamp AS ms_ago,
+    rb.record.value('(./Record/SchedulerMonitorEvent/SystemHealth/ProcessUtilization)[1]', 'int') AS sql_cpu,
+    rb.record.value('(./Record/SchedulerMonitorEvent/SystemHealth/SystemIdle)[1]', 'int') AS system_idle
+  FROM (
+    SELECT timestamp, CONVERT(xml, record) AS record
+    FROM sys.dm_os_ring_buffers
+    WHERE ring_buffer_type = N'RING_BUFFER_SCHEDULER_MONITOR' AND record LIKE N'%<SystemHealth>%'
+  ) rb
+  CROSS JOIN sys.dm_os_sys_info si
+)
+SELECT record_id, ms_ago, sql_cpu, system_idle
+FROM records
+WHERE (@p1 = 0 AND record_id = (SELECT MAX(record_id) FROM records))
+  OR (@p1 > 0 AND (record_id > @p1 OR (SELECT MAX(record_id) FROM records) < @p1))
+ORDER BY record_id
+`
+	var rows []cpuRecordRow
+	err := selectRows(ctx, dbcli, &rows, sql, lastID)
+	if err != nil {
+		return err
+	}
+
+	if len(rows) > 0 {
+		last := rows[len(rows)-1]
+		s.lastRecord = &last
+		s.lastTime = time.Now().Add(-time.Duration(last.MsAgo) * time.Millisecond)
+
+		s.maxSQL, s.maxOther = 0, 0
+		for _, r := range rows {
+			s.maxSQL = math.Max(s.maxSQL, r.SQLCPU)
+			s.maxOther = math.Max(s.maxOther, nonNegativeFloat(100-r.SQLCPU-r.SystemIdle))
+		}
+	}
+	if s.lastRecord == nil {
+		return nil
+	}
+
+	r := s.lastRecord
+	ch <- prometheus.MustNewConstMetric(cpuSQLProcessDesc, prometheus.GaugeValue, r.SQLCPU)
+	ch <- prometheus.MustNewConstMetric(cpuSystemIdleDesc, prometheus.GaugeValue, r.SystemIdle)
+	ch <- prometheus.MustNewConstMetric(cpuOtherProcessDesc, prometheus.GaugeValue, nonNegativeFloat(100-r.SQLCPU-r.SystemIdle))
+	ch <- prometheus.MustNewConstMetric(cpuSQLProcessMaxDesc, prometheus.GaugeValue, s.maxSQL)
+	ch <- prometheus.MustNewConstMetric(cpuOtherProcessMaxDesc, prometheus.GaugeValue, s.maxOther)
+	ch <- prometheus.MustNewConstMetric(cpuRecordTimeDesc, prometheus.GaugeValue, float64(s.lastTime.Unix()))
+	return nil
+}
+
+func (s *ScrapeCPU) scrapeSchedulers(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	sql := `SELECT scheduler_id, cpu_id, parent_node_id, current_tasks_count, runnable_tasks_count,
+  work_queue_count, pending_disk_io_count
+FROM sys.dm_os_schedulers
+WHERE status = 'VISIBLE ONLINE'
+`
+	var rows []schedulerRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		labels := []string{formatInt64(r.SchedulerID), formatInt64(r.CPUID), formatInt64(r.ParentNodeID)}
+		ch <- prometheus.MustNewConstMetric(schedulerCurrentTasksDesc, prometheus.GaugeValue, r.CurrentTasks, labels...)
+		ch <- prometheus.MustNewConstMetric(schedulerRunnableTasksDesc, prometheus.GaugeValue, r.RunnableTasks, labels...)
+		ch <- prometheus.MustNewConstMetric(schedulerWorkQueueDesc, prometheus.GaugeValue, r.WorkQueue, labels...)
+		ch <- prometheus.MustNewConstMetric(schedulerPendingIODesc, prometheus.GaugeValue, r.PendingDiskIO, labels...)
+	}
+	return nil
+}
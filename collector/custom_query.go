@@ -0,0 +1,250 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// QueryConfig defines a collector running a user defined query.
+//
+//	queries:
+//	  - name: app_queue
+//	    help: Application queues
+//	    databases: [appdb]
+//	    interval: 1m
+//	    timeout: 10s
+//	    query: select queue_name, depth, processed from dbo.queues
+//	    labels: [queue_name]
+//	    values:
+//	      - column: depth
+//	        type: gauge
+//	      - column: processed
+//	        name: processed_total
+//	        type: counter
+//
+// exports mssql_app_queue_depth and mssql_app_queue_processed_total with the labels
+// queue_name and database.
+type QueryConfig struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	// Databases the query runs in, master when empty.
+	Databases []string      `yaml:"databases"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Query     string        `yaml:"query"`
+	// Labels are the columns exported as labels.
+	Labels []string     `yaml:"labels"`
+	Values []QueryValue `yaml:"values"`
+}
+
+// QueryValue is a column exported as metric value.
+type QueryValue struct {
+	Column string `yaml:"column"`
+	// Name of the metric after the query name, defaults to the column name.
+	Name string `yaml:"name"`
+	// Type is gauge or counter, defaults to gauge.
+	Type string `yaml:"type"`
+}
+
+func (q *QueryConfig) Validate() error {
+	if !metricNamePattern.MatchString(q.Name) {
+		return fmt.Errorf("invalid query name %q", q.Name)
+	}
+	if q.Query == "" {
+		return fmt.Errorf("query %q has no query", q.Name)
+	}
+	if len(q.Values) == 0 {
+		return fmt.Errorf("query %q has no values", q.Name)
+	}
+	if q.Interval < 0 || q.Timeout < 0 {
+		return fmt.Errorf("query %q has a negative interval or timeout", q.Name)
+	}
+
+	columns := make(map[string]bool)
+	for _, label := range q.Labels {
+		if !metricNamePattern.MatchString(label) || label == "database" {
+			return fmt.Errorf("query %q has invalid label %q", q.Name, label)
+		}
+		if columns[label] {
+			return fmt.Errorf("query %q has duplicate column %q", q.Name, label)
+		}
+		columns[label] = true
+	}
+
+	names := make(map[string]bool)
+	for _, v := range q.Values {
+		if v.Column == "" {
+			return fmt.Errorf("query %q has a value without column", q.Name)
+		}
+		if columns[v.Column] {
+			return fmt.Errorf("query %q has duplicate column %q", q.Name, v.Column)
+		}
+		columns[v.Column] = true
+
+		name := v.metricName()
+		if !metricNamePattern.MatchString(name) || names[name] {
+			return fmt.Errorf("query %q has invalid or duplicate metric name %q", q.Name, name)
+		}
+		names[name] = true
+
+		fullName := q.Name + "_" + name
+		if fullName == "up" {
+			return fmt.Errorf("query %q has metric name %s_%s of a built-in metric", q.Name, namespace, fullName)
+		}
+		for sub := range builtinSubsystems {
+			if strings.HasPrefix(fullName, sub+"_") {
+				return fmt.Errorf("query %q has metric name %s_%s clashing with the built-in %s_%s_ metrics",
+					q.Name, namespace, fullName, namespace, sub)
+			}
+		}
+
+		if v.Type != "" && v.Type != "gauge" && v.Type != "counter" {
+			return fmt.Errorf("query %q has invalid type %q for column %q", q.Name, v.Type, v.Column)
+		}
+	}
+	return nil
+}
+
+// MetricNames returns the names of the metrics of the query.
+func (q *QueryConfig) MetricNames() []string {
+	var result []string
+	for _, v := range q.Values {
+		result = append(result, prometheus.BuildFQName(namespace, q.Name, v.metricName()))
+	}
+	return result
+}
+
+// Settings returns the scheduler settings of the query.
+func (q *QueryConfig) Settings() Settings {
+	return Settings{Interval: q.Interval, Timeout: q.Timeout}
+}
+
+func (v QueryValue) metricName() string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return v.Column
+}
+
+func (v QueryValue) valueType() prometheus.ValueType {
+	if v.Type == "counter" {
+		return prometheus.CounterValue
+	}
+	return prometheus.GaugeValue
+}
+
+// ScrapeCustomQuery runs a user defined query.
+type ScrapeCustomQuery struct {
+	config QueryConfig
+	descs  []*prometheus.Desc
+}
+
+// NewScrapeCustomQuery returns a scraper for the query, q must be valid.
+func NewScrapeCustomQuery(q QueryConfig) *ScrapeCustomQuery {
+	help := q.Help
+	if help == "" {
+		help = "Custom query " + q.Name
+	}
+
+	labels := append(append([]string{}, q.Labels...), "database")
+
+	s := ScrapeCustomQuery{config: q}
+	for _, v := range q.Values {
+		s.descs = append(s.descs, prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, q.Name, v.metricName()),
+			help, labels, nil))
+	}
+	return &s
+}
+
+func (s ScrapeCustomQuery) Name() string {
+	return s.config.Name
+}
+
+func (s ScrapeCustomQuery) Help() string {
+	if s.config.Help != "" {
+		return s.config.Help
+	}
+	return "collect custom query " + s.config.Name
+}
+
+func (ScrapeCustomQuery) Version() float64 {
+	return 0
+}
+
+func (s *ScrapeCustomQuery) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	databases := s.config.Databases
+	if len(databases) == 0 {
+		databases = []string{"master"}
+	}
+
+	return forEachOf(ctx, databases, s.Name(), func(db string) error {
+		return s.scrapeDatabase(ctx, dbcli, ch, db)
+	})
+}
+
+func (s *ScrapeCustomQuery) scrapeDatabase(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, db string) error {
+	result, err := dbcli.FetchResultWithContext(ctx, dbutil.InDatabase(db, s.config.Query))
+	if err != nil {
+		return err
+	}
+
+	labelIndex := make([]int, len(s.config.Labels))
+	for i, label := range s.config.Labels {
+		labelIndex[i] = result.ColumnIndex(label)
+		if labelIndex[i] < 0 {
+			return fmt.Errorf("no column %q in result set", label)
+		}
+	}
+
+	valueIndex := make([]int, len(s.config.Values))
+	for i, v := range s.config.Values {
+		valueIndex[i] = result.ColumnIndex(v.Column)
+		if valueIndex[i] < 0 {
+			return fmt.Errorf("no column %q in result set", v.Column)
+		}
+	}
+
+	// rows with the same label values as an earlier row are skipped,
+	// a metric sent twice fails the whole scrape
+	seen := make(map[string]bool)
+	skipped := 0
+	for _, r := range result.Rows {
+		labelValues := make([]string, 0, len(labelIndex)+1)
+		for _, idx := range labelIndex {
+			labelValues = append(labelValues, result.String(r, idx))
+		}
+		labelValues = append(labelValues, db)
+
+		key := strings.Join(labelValues, "\x00")
+		if seen[key] {
+			skipped++
+			continue
+		}
+		seen[key] = true
+
+		for i, v := range s.config.Values {
+			value, err := result.Float64(r, valueIndex[i])
+			if err != nil {
+				skipped++
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(s.descs[i], v.valueType(), value, labelValues...)
+		}
+	}
+
+	if counter, ok := ctx.Value(skippedRowsKey{}).(prometheus.Counter); ok && skipped > 0 {
+		counter.Add(float64(skipped))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	databaseInclude = kingpin.Flag(
+		"collect.databases.include",
+		"Regular expression of the user databases per database collectors run in, all databases when not set.",
+	).Regexp()
+
+	databaseExclude = kingpin.Flag(
+		"collect.databases.exclude",
+		"Regular expression of the user databases per database collectors skip.",
+	).Regexp()
+)
+
+type databaseNameRow struct {
+	Name string `db:"name"`
+}
+
+// databaseSelected reports whether the database matches --collect.databases.include
+// and not --collect.databases.exclude.
+func databaseSelected(name string) bool {
+	if *databaseInclude != nil && !(*databaseInclude).MatchString(name) {
+		return false
+	}
+	if *databaseExclude != nil && (*databaseExclude).MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// listDatabases returns the selected user databases which are online, not in single user
+// mode and accessible by the login, so not readable secondary replicas are left out.
+func listDatabases(ctx context.Context, dbcli *dbutil.MSSQLClient) ([]string, error) {
+	sql := `SELECT name FROM sys.databases
+WHERE database_id > 4 AND state = 0 AND user_access <> 1 AND source_database_id IS NULL
+  AND HAS_DBACCESS(name) = 1
+ORDER BY name
+`
+	var rows []databaseNameRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	var databases []string
+	for _, r := range rows {
+		if databaseSelected(r.Name) {
+			databases = append(databases, r.Name)
+		}
+	}
+	return databases, nil
+}
+
+// forEachDatabase calls fn with every database of listDatabases, fn runs its queries in the
+// database with dbutil.InDatabase. Failing databases are handled by forEachOf.
+func forEachDatabase(ctx context.Context, dbcli *dbutil.MSSQLClient, scraper string, fn func(db string) error) error {
+	databases, err := listDatabases(ctx, dbcli)
+	if err != nil {
+		return err
+	}
+	return forEachOf(ctx, databases, scraper, fn)
+}
+
+// forEachOf calls fn with every database of databases. A database failing does not stop the
+// others, it is logged and the error is only returned when every database failed or ctx is done.
+func forEachOf(ctx context.Context, databases []string, scraper string, fn func(db string) error) error {
+	var lastErr error
+	failed := 0
+	for _, db := range databases {
+		err := fn(db)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.WithFields(log.Fields{"scraper": scraper, "database": db, "error": err}).Warn("Scrape Database")
+		lastErr = fmt.Errorf("database %s: %w", db, err)
+		failed++
+	}
+
+	if failed > 0 && failed == len(databases) {
+		return lastErr
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	dbLogSizeDesc = newDesc("db_log", "size_bytes",
+		"Size of the transaction log of the database.",
+		[]string{"database"})
+
+	dbLogUsedDesc = newDesc("db_log", "used_bytes",
+		"Used space of the transaction log of the database.",
+		[]string{"database"})
+
+	dbLogUsedPercentDesc = newDesc("db_log", "used_percent",
+		"Used space of the transaction log of the database, in percent of the log size.",
+		[]string{"database"})
+
+	dbLogReuseWaitDesc = newDesc("db_log", "reuse_wait",
+		"Reason the transaction log of the database can not be truncated, 1 for the current reason.",
+		[]string{"database", "reason"})
+
+	dbLogVlfDesc = newDesc("db_log", "vlf_count",
+		"Number of virtual log files of the database.",
+		[]string{"database"})
+
+	dbLogActiveVlfDesc = newDesc("db_log", "active_vlf_count",
+		"Number of active virtual log files of the database.",
+		[]string{"database"})
+
+	dbLogFileDescs = newFileSettingsDescs("db_log", "transaction log file", []string{"database", "file"})
+
+	// dbLogReuseWaits are the values of sys.databases.log_reuse_wait_desc
+	dbLogReuseWaits = []string{
+		"NOTHING",
+		"CHECKPOINT",
+		"LOG_BACKUP",
+		"ACTIVE_BACKUP_OR_RESTORE",
+		"ACTIVE_TRANSACTION",
+		"DATABASE_MIRRORING",
+		"REPLICATION",
+		"DATABASE_SNAPSHOT_CREATION",
+		"LOG_SCAN",
+		"AVAILABILITY_REPLICA",
+		"OLDEST_PAGE",
+		"XTP_CHECKPOINT",
+		"SLOG_SCAN",
+		"OTHER_TRANSIENT",
+	}
+
+	intervalDbLog = 30 * time.Second
+)
+
+// dbLogRow is the log usage of a database, the usage columns are NULL when the
+// log of the database could not be read.
+type dbLogRow struct {
+	DatabaseName string   `db:"database_name"`
+	ReuseWait    string   `db:"log_reuse_wait_desc,nullable"`
+	LogSize      *float64 `db:"log_size"`
+	LogUsed      *float64 `db:"log_used"`
+}
+
+// dbLogLogInfo counts the VLFs of database @name with DBCC LOGINFO into @vlf.
+const dbLogLogInfo = `DELETE FROM @loginfo;
+    SET @sql = N'DBCC LOGINFO(' + CAST(DB_ID(@name) AS nvarchar(10)) + N') WITH NO_INFOMSGS';
+    INSERT INTO @loginfo EXEC (@sql);
+    INSERT INTO @vlf SELECT @name, COUNT(*), ISNULL(SUM(CASE WHEN status = 2 THEN 1 ELSE 0 END), 0) FROM @loginfo;`
+
+// dbLogForEachDatabase returns a batch running stmt for every online database the login can
+// access, with the database name in @name and @sql declared. A database failing, e.g. going
+// offline meanwhile, is skipped instead of failing the batch.
+func dbLogForEachDatabase(stmt string) string {
+	return `DECLARE @name sysname, @sql nvarchar(max);
+DECLARE dbs CURSOR LOCAL FAST_FORWARD FOR
+  SELECT name FROM sys.databases
+  WHERE state = 0 AND user_access <> 1 AND source_database_id IS NULL AND HAS_DBACCESS(name) = 1;
+OPEN dbs;
+FETCH NEXT FROM dbs INTO @name;
+WHILE @@FETCH_STATUS = 0
+BEGIN
+  BEGIN TRY
+    ` + stmt + `
+  END TRY
+  BEGIN CATCH
+  END CATCH;
+  FETCH NEXT FROM dbs INTO @name;
+END
+CLOSE dbs;
+DEALLOCATE dbs;
+`
+}
+
+type dbLogVlfRow struct {
+	DatabaseName string  `db:"database_name"`
+	VlfCount     float64 `db:"vlf_count"`
+	ActiveCount  float64 `db:"active_vlf_count"`
+}
+
+// ScrapeDbLog collects the usage, the truncation state and the growth settings of the transaction logs.
+type ScrapeDbLog struct{}
+
+func (ScrapeDbLog) Name() string {
+	return "mssql_db_log"
+}
+
+func (ScrapeDbLog) Help() string {
+	return "collect transaction log usage, reuse wait, virtual log files and growth settings"
+}
+
+func (ScrapeDbLog) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeDbLog) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	err := s.scrapeUsage(ctx, dbcli, ch, ins)
+	if err != nil {
+		return err
+	}
+	err = s.scrapeFiles(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+
+	return s.scrapeVlfs(ctx, dbcli, ch, ins)
+}
+
+func (s *ScrapeDbLog) scrapeUsage(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// sys.dm_db_log_space_usage only reports the log of the current database, so it is
+	// queried in every database the login can access from 2012; the other databases, the
+	// ones failing and older versions fall back to DBCC SQLPERF(LOGSPACE)
+	usage := ""
+	if ins.ServerVersion.AtLeast(11, 0) {
+		usage = dbLogForEachDatabase(`SET @sql = N'USE ' + QUOTENAME(@name) + N'; SELECT DB_NAME(), total_log_size_in_bytes, used_log_space_in_bytes FROM sys.dm_db_log_space_usage;';
+    INSERT INTO @logspace EXEC (@sql);`)
+	}
+
+	sql := `SET NOCOUNT ON;
+DECLARE @logspace TABLE (database_name sysname, log_size float, log_used float);
+DECLARE @sqlperf TABLE (database_name sysname, log_size_mb float, log_used_percent float, status int);
+` + usage + `INSERT INTO @sqlperf EXEC ('DBCC SQLPERF(LOGSPACE) WITH NO_INFOMSGS');
+INSERT INTO @logspace
+SELECT p.database_name, p.log_size_mb * 1048576, p.log_size_mb * 1048576 * p.log_used_percent / 100
+FROM @sqlperf p
+WHERE NOT EXISTS (SELECT 1 FROM @logspace l WHERE l.database_name = p.database_name);
+SELECT d.name AS database_name, d.log_reuse_wait_desc, l.log_size, l.log_used
+FROM sys.databases d
+LEFT JOIN @logspace l ON l.database_name = d.name
+WHERE d.state = 0 AND d.source_database_id IS NULL
+`
+	var rows []dbLogRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		if r.LogSize != nil && r.LogUsed != nil {
+			ch <- prometheus.MustNewConstMetric(dbLogSizeDesc, prometheus.GaugeValue, *r.LogSize, r.DatabaseName)
+			ch <- prometheus.MustNewConstMetric(dbLogUsedDesc, prometheus.GaugeValue, *r.LogUsed, r.DatabaseName)
+			if *r.LogSize > 0 {
+				ch <- prometheus.MustNewConstMetric(dbLogUsedPercentDesc, prometheus.GaugeValue,
+					*r.LogUsed / *r.LogSize * 100, r.DatabaseName)
+			}
+		}
+
+		if r.ReuseWait == "" {
+			continue
+		}
+		sendStateSet(ch, dbLogReuseWaitDesc, dbLogReuseWaits, r.ReuseWait, r.DatabaseName)
+	}
+	return nil
+}
+
+func (s *ScrapeDbLog) scrapeFiles(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	rows, err := selectFileSettings(ctx, dbcli, "d.name", `FROM sys.master_files f
+JOIN sys.databases d ON d.database_id = f.database_id
+WHERE f.type = 1 AND d.source_database_id IS NULL
+`)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		dbLogFileDescs.send(ch, r, r.DatabaseName, r.FileName)
+	}
+	return nil
+}
+
+func (s *ScrapeDbLog) scrapeVlfs(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// sys.dm_db_log_info is available from 2016 SP2, DBCC LOGINFO before, which has a
+	// RecoveryUnitId column from 2012 and status 2 for active VLFs
+	var vlfs string
+	switch {
+	case ins.ServerVersion.AtLeastBuild(13, 0, 5026):
+		vlfs = dbLogForEachDatabase(`INSERT INTO @vlf
+    SELECT @name, COUNT(*), ISNULL(SUM(CASE WHEN vlf_active = 1 THEN 1 ELSE 0 END), 0) FROM sys.dm_db_log_info(DB_ID(@name));`)
+	case ins.ServerVersion.AtLeast(11, 0):
+		vlfs = `DECLARE @loginfo TABLE (recovery_unit_id int, file_id int, file_size bigint, start_offset bigint,
+  fseq_no bigint, status int, parity int, create_lsn numeric(25, 0));
+` + dbLogForEachDatabase(dbLogLogInfo)
+	default:
+		vlfs = `DECLARE @loginfo TABLE (file_id int, file_size bigint, start_offset bigint,
+  fseq_no bigint, status int, parity int, create_lsn numeric(25, 0));
+` + dbLogForEachDatabase(dbLogLogInfo)
+	}
+
+	sql := `SET NOCOUNT ON;
+DECLARE @vlf TABLE (database_name sysname, vlf_count int, active_vlf_count int);
+` + vlfs + `SELECT database_name, vlf_count, active_vlf_count FROM @vlf
+`
+	var rows []dbLogVlfRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		ch <- prometheus.MustNewConstMetric(dbLogVlfDesc, prometheus.GaugeValue, r.VlfCount, r.DatabaseName)
+		ch <- prometheus.MustNewConstMetric(dbLogActiveVlfDesc, prometheus.GaugeValue, r.ActiveCount, r.DatabaseName)
+	}
+	return nil
+}
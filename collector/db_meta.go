@@ -11,12 +11,23 @@ import (
 var (
 	dbMetaCols = []string{"name", "database_id", "create_date", "compatibility_level", "collation_name", "recovery_model",
 		"snapshot_isolation", "read_committed_snapshot"}
-	dbMetaDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "database", "meta"),
+	dbMetaDesc = newDesc("database", "meta",
 		"MSSQL Database Space Info",
-		dbMetaCols, nil)
+		dbMetaCols)
 )
 
+type dbMetaRow struct {
+	Name                      string    `db:"name"`
+	DatabaseID                int64     `db:"database_id"`
+	CreateDate                time.Time `db:"create_date"`
+	CompatibilityLevel        int64     `db:"compatibility_level"`
+	CollationName             string    `db:"collation_name,nullable"`
+	RecoveryModel             string    `db:"recovery_model_desc,nullable"`
+	SnapshotIsolationState    int64     `db:"snapshot_isolation_state,nullable"`
+	IsReadCommittedSnapshotOn bool      `db:"is_read_committed_snapshot_on,nullable"`
+	State                     int64     `db:"state,nullable"`
+}
+
 type ScrapeDbMeta struct {
 	lastTime time.Time
 }
@@ -31,7 +42,7 @@ func (ScrapeDbMeta) Help() string {
 }
 
 func (ScrapeDbMeta) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeDbMeta) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
@@ -40,23 +51,24 @@ func (s *ScrapeDbMeta) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch
 	snapshot_isolation_state, is_read_committed_snapshot_on, state, user_access
 from sys.databases`
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []dbMetaRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	for _, r := range rows {
 
 		ch <- prometheus.MustNewConstMetric(
-			dbMetaDesc, prometheus.GaugeValue, float64(r[8].(int64)),
-			r[0].(string),
-			formatInt64(r[1].(int64)),
-			formatTime(r[2].(time.Time)),
-			formatInt64((r[3].(int64))),
-			r[4].(string),
-			r[5].(string),
-			formatInt64(r[6].(int64)),
-			formatBool(r[7].(bool)),
+			dbMetaDesc, prometheus.GaugeValue, float64(r.State),
+			r.Name,
+			formatInt64(r.DatabaseID),
+			formatTime(r.CreateDate),
+			formatInt64(r.CompatibilityLevel),
+			r.CollationName,
+			r.RecoveryModel,
+			formatInt64(r.SnapshotIsolationState),
+			formatBool(r.IsReadCommittedSnapshotOn),
 		)
 
 	}
@@ -9,18 +9,22 @@ import (
 )
 
 var (
-	dbSpaceDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "database", "space"),
+	dbSpaceDesc = newDesc("database", "space",
 		"MSSQL Database Space Info",
-		[]string{"db_name", "mode"}, nil)
+		[]string{"db_name", "mode"})
 
 	intervalDbSpace = 30 * time.Second
 )
 
-type ScrapeDbSpace struct {
-	lastTime time.Time
+type dbSpaceRow struct {
+	DbName    string `db:"db_name"`
+	DataSize  int64  `db:"data_size"`
+	LogSize   int64  `db:"log_size"`
+	OtherSize int64  `db:"other_size"`
 }
 
+type ScrapeDbSpace struct{}
+
 func (ScrapeDbSpace) Name() string {
 	return "mssql_db_space"
 }
@@ -31,43 +35,34 @@ func (ScrapeDbSpace) Help() string {
 }
 
 func (ScrapeDbSpace) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeDbSpace) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
-	duration := time.Since(s.lastTime)
-	if duration < intervalDbSpace {
-		return nil
-	}
-
-	sql := `select DB_NAME(database_id), 
+	sql := `select DB_NAME(database_id) db_name, 
      SUM(case when type=0 then cast (size as bigint) else 0 end) * 8192  data_size, 
      sum(case when type=1 then cast (size as bigint) else 0 end) * 8192  log_size,
 	 SUM(case when type > 1 then cast (size as bigint) else 0 end) * 8192 other_size
  from sys.master_files
+ where DB_NAME(database_id) is not null
  group by DB_NAME(database_id)`
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []dbSpaceRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	currentTime := time.Now()
-
 	for _, r := range rows {
-		dbName := r[0].(string)
-
 		ch <- prometheus.MustNewConstMetric(
-			dbSpaceDesc, prometheus.GaugeValue, float64(r[1].(int64)), dbName, "data")
+			dbSpaceDesc, prometheus.GaugeValue, float64(r.DataSize), r.DbName, "data")
 
 		ch <- prometheus.MustNewConstMetric(
-			dbSpaceDesc, prometheus.GaugeValue, float64(r[2].(int64)), dbName, "log")
+			dbSpaceDesc, prometheus.GaugeValue, float64(r.LogSize), r.DbName, "log")
 
 		ch <- prometheus.MustNewConstMetric(
-			dbSpaceDesc, prometheus.GaugeValue, float64(r[3].(int64)), dbName, "other")
+			dbSpaceDesc, prometheus.GaugeValue, float64(r.OtherSize), r.DbName, "other")
 	}
 
-	s.lastTime = currentTime
-
 	return nil
 }
@@ -0,0 +1,450 @@
+package collector
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	// maxDeadlockObjects bounds the objects counted by mssql_deadlock, deadlocks on
+	// further objects are counted with object "other".
+	maxDeadlockObjects = 1000
+)
+
+var (
+	deadlockArchiveSize = kingpin.Flag(
+		"collect.mssql_deadlock.archive-size",
+		"Number of most recent deadlock graphs kept per target by mssql_deadlock.",
+	).Default("100").Int()
+
+	deadlockSource = kingpin.Flag(
+		"collect.mssql_deadlock.source",
+		"Target of the system_health session mssql_deadlock reads: ring_buffer, or event_file which keeps more history.",
+	).Default("ring_buffer").Enum("ring_buffer", "event_file")
+
+	deadlocksDesc = newDesc("deadlocks", "total",
+		"Number of deadlocks read from the system_health session by database of the deadlocked resources.",
+		[]string{"database"})
+
+	deadlockObjectsDesc = newDesc("deadlock", "objects_total",
+		"Number of deadlocks read from the system_health session by deadlocked object and index.",
+		[]string{"database", "object", "index"})
+
+	deadlockLastDesc = newDesc("deadlock", "last_timestamp_seconds",
+		"Time of the last deadlock read from the system_health session.",
+		nil)
+
+	intervalDeadlock = time.Minute
+)
+
+// Deadlock is a deadlock graph of an xml_deadlock_report event.
+type Deadlock struct {
+	Time      time.Time          `json:"time"`
+	Victims   []string           `json:"victims"`
+	Processes []DeadlockProcess  `json:"processes"`
+	Resources []DeadlockResource `json:"resources"`
+}
+
+// DeadlockProcess is a session taking part in a deadlock.
+type DeadlockProcess struct {
+	ID              string   `json:"id"`
+	Victim          bool     `json:"victim"`
+	SessionID       int64    `json:"session_id"`
+	Database        string   `json:"database"`
+	LoginName       string   `json:"login_name"`
+	HostName        string   `json:"host_name"`
+	ClientApp       string   `json:"client_app"`
+	IsolationLevel  string   `json:"isolation_level"`
+	TransactionName string   `json:"transaction_name"`
+	LockMode        string   `json:"lock_mode"`
+	WaitResource    string   `json:"wait_resource"`
+	WaitTimeMs      int64    `json:"wait_time_ms"`
+	LogUsed         int64    `json:"log_used"`
+	Statements      []string `json:"statements"`
+	InputBuffer     string   `json:"input_buffer"`
+}
+
+// DeadlockResource is a lock resource of a deadlock with its owners and waiters.
+type DeadlockResource struct {
+	Type     string         `json:"type"`
+	Database string         `json:"database"`
+	Object   string         `json:"object"`
+	Index    string         `json:"index"`
+	Mode     string         `json:"mode"`
+	Owners   []DeadlockLock `json:"owners"`
+	Waiters  []DeadlockLock `json:"waiters"`
+}
+
+// DeadlockLock is a lock held or requested by a process on a resource.
+type DeadlockLock struct {
+	Process string `json:"process"`
+	Mode    string `json:"mode"`
+}
+
+// deadlockGraph is the deadlock element of an xml_deadlock_report event.
+type deadlockGraph struct {
+	Victims []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"victim-list>victimProcess"`
+	Processes []struct {
+		ID              string `xml:"id,attr"`
+		SPID            int64  `xml:"spid,attr"`
+		CurrentDB       int64  `xml:"currentdb,attr"`
+		CurrentDBName   string `xml:"currentdbname,attr"`
+		LoginName       string `xml:"loginname,attr"`
+		HostName        string `xml:"hostname,attr"`
+		ClientApp       string `xml:"clientapp,attr"`
+		IsolationLevel  string `xml:"isolationlevel,attr"`
+		TransactionName string `xml:"transactionname,attr"`
+		LockMode        string `xml:"lockMode,attr"`
+		WaitResource    string `xml:"waitresource,attr"`
+		WaitTime        int64  `xml:"waittime,attr"`
+		LogUsed         int64  `xml:"logused,attr"`
+		Frames          []struct {
+			ProcName string `xml:"procname,attr"`
+			Text     string `xml:",chardata"`
+		} `xml:"executionStack>frame"`
+		InputBuffer string `xml:"inputbuf"`
+	} `xml:"process-list>process"`
+	Resources struct {
+		Items []struct {
+			XMLName    xml.Name
+			DBID       int64          `xml:"dbid,attr"`
+			ObjectName string         `xml:"objectname,attr"`
+			IndexName  string         `xml:"indexname,attr"`
+			Mode       string         `xml:"mode,attr"`
+			Owners     []DeadlockLock `xml:"owner-list>owner"`
+			Waiters    []DeadlockLock `xml:"waiter-list>waiter"`
+		} `xml:",any"`
+	} `xml:"resource-list"`
+}
+
+// UnmarshalXML reads the id and mode attributes of an owner or waiter element.
+func (l *DeadlockLock) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "id":
+			l.Process = attr.Value
+		case "mode":
+			l.Mode = attr.Value
+		}
+	}
+	return d.Skip()
+}
+
+// deadlockEventRow is an xml_deadlock_report event, the file and offset are those of the
+// event file, empty for the ring buffer.
+type deadlockEventRow struct {
+	EventTime  time.Time `db:"event_time"`
+	Report     string    `db:"report"`
+	FileName   string    `db:"file_name"`
+	FileOffset int64     `db:"file_offset"`
+}
+
+type deadlockObjectKey struct {
+	database, object, index string
+}
+
+// ScrapeDeadlock reads the xml_deadlock_report events of the ring buffer or event files of the
+// system_health session newer than the last read event, counts them by database and object and keeps the
+// most recent deadlock graphs.
+type ScrapeDeadlock struct {
+	mu sync.Mutex
+	// cursor is the time of the last read event, seen holds the reports read at that time
+	// since several deadlocks may be reported at the same millisecond.
+	cursor time.Time
+	seen   map[string]bool
+	// file and offset are the position of the last read event in the event files,
+	// so the files are only read from there on
+	file   string
+	offset int64
+	// started is set after the first read, whose events are archived but not counted
+	// since they happened before the exporter started.
+	started   bool
+	databases map[string]float64
+	objects   map[deadlockObjectKey]float64
+	archive   []Deadlock
+}
+
+func (*ScrapeDeadlock) Name() string {
+	return "mssql_deadlock"
+}
+
+func (*ScrapeDeadlock) Help() string {
+	return "collect deadlocks from the system_health extended events session"
+}
+
+func (*ScrapeDeadlock) Version() float64 {
+	return 11.0
+}
+
+func (s *ScrapeDeadlock) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// event timestamps are in UTC
+	sql := `SELECT x.event.value('@timestamp', 'datetime2(3)') AS event_time,
+  CAST(x.event.query('data[@name="xml_report"]/value/deadlock') AS nvarchar(max)) AS report,
+  N'' AS file_name, CAST(0 AS bigint) AS file_offset
+FROM (
+  SELECT CAST(t.target_data AS xml) AS target_data
+  FROM sys.dm_xe_session_targets t
+  JOIN sys.dm_xe_sessions se ON se.address = t.event_session_address
+  WHERE se.name = N'system_health' AND t.target_name = N'ring_buffer'
+) rb
+CROSS APPLY rb.target_data.nodes('RingBufferTarget/event[@name="xml_deadlock_report"]') AS x(event)
+WHERE x.event.value('@timestamp', 'datetime2(3)') >= @p1
+ORDER BY event_time
+`
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cursor := s.cursor.Format("2006-01-02T15:04:05.000")
+	var rows []deadlockEventRow
+	var err error
+	if *deadlockSource == "event_file" {
+		rows, err = s.readEventFiles(ctx, dbcli, cursor)
+	} else {
+		err = selectRows(ctx, dbcli, &rows, sql, cursor)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the cursor only moves once the names are known, so a failed lookup reads the events again
+	var names map[int64]string
+	if len(rows) > 0 {
+		names, err = databaseNames(ctx, dbcli)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range rows {
+		key := getMd5(r.Report)
+		if r.EventTime.Equal(s.cursor) && s.seen[key] {
+			continue
+		}
+		if !r.EventTime.Equal(s.cursor) {
+			s.cursor = r.EventTime
+			s.seen = make(map[string]bool)
+		}
+		s.seen[key] = true
+
+		d, err := parseDeadlock(r.Report, names)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "time": r.EventTime}).Warn("Parse Deadlock")
+			continue
+		}
+		d.Time = r.EventTime.UTC()
+		s.add(d, s.started)
+	}
+	if len(rows) > 0 && rows[len(rows)-1].FileName != "" {
+		s.file = rows[len(rows)-1].FileName
+		s.offset = rows[len(rows)-1].FileOffset
+	}
+	s.started = true
+
+	for db, n := range s.databases {
+		ch <- prometheus.MustNewConstMetric(deadlocksDesc, prometheus.CounterValue, n, db)
+	}
+	for k, n := range s.objects {
+		ch <- prometheus.MustNewConstMetric(deadlockObjectsDesc, prometheus.CounterValue, n, k.database, k.object, k.index)
+	}
+	if len(s.archive) > 0 {
+		ch <- prometheus.MustNewConstMetric(deadlockLastDesc, prometheus.GaugeValue,
+			float64(s.archive[len(s.archive)-1].Time.Unix()))
+	}
+	return nil
+}
+
+// readEventFiles reads the deadlock events of the system_health event files from the file and
+// offset of the last read event, or all files before the first read. The events at the offset
+// are returned again and skipped by the time cursor.
+func (s *ScrapeDeadlock) readEventFiles(ctx context.Context, dbcli *dbutil.MSSQLClient, cursor string) ([]deadlockEventRow, error) {
+	// a relative path is looked up in the log directory of the instance, only the
+	// deadlock events are cast to xml
+	sql := `SELECT x.event.value('@timestamp', 'datetime2(3)') AS event_time,
+  CAST(x.event.query('data[@name="xml_report"]/value/deadlock') AS nvarchar(max)) AS report,
+  f.file_name, f.file_offset
+FROM (
+  SELECT CAST(event_data AS xml) AS event_data, file_name, file_offset
+  FROM sys.fn_xe_file_target_read_file(N'system_health*.xel', NULL, %s)
+  WHERE object_name = N'xml_deadlock_report'
+) f
+CROSS APPLY f.event_data.nodes('event') AS x(event)
+WHERE x.event.value('@timestamp', 'datetime2(3)') >= @p1
+ORDER BY event_time
+`
+	var rows []deadlockEventRow
+	if s.file != "" {
+		err := selectRows(ctx, dbcli, &rows, fmt.Sprintf(sql, "@p2, @p3"), cursor, s.file, s.offset)
+		if err == nil || ctx.Err() != nil {
+			return rows, err
+		}
+		// the file of the last read event is gone after a rollover, read all files again
+		log.WithFields(log.Fields{"file": s.file, "offset": s.offset, "error": err}).Warn("Read Deadlock Event File")
+		s.file, s.offset = "", 0
+		rows = nil
+	}
+
+	err := selectRows(ctx, dbcli, &rows, fmt.Sprintf(sql, "NULL, NULL"), cursor)
+	return rows, err
+}
+
+// add appends the deadlock to the archive, and counts it when count is set.
+func (s *ScrapeDeadlock) add(d Deadlock, count bool) {
+	s.archive = append(s.archive, d)
+	if len(s.archive) > *deadlockArchiveSize {
+		s.archive = append([]Deadlock(nil), s.archive[len(s.archive)-*deadlockArchiveSize:]...)
+	}
+	if !count {
+		return
+	}
+
+	if s.databases == nil {
+		s.databases = make(map[string]float64)
+		s.objects = make(map[deadlockObjectKey]float64)
+	}
+
+	databases := make(map[string]bool)
+	objects := make(map[deadlockObjectKey]bool)
+	for _, r := range d.Resources {
+		if r.Database != "" {
+			databases[r.Database] = true
+		}
+		if r.Object != "" {
+			objects[deadlockObjectKey{r.Database, r.Object, r.Index}] = true
+		}
+	}
+	// resources like exchange events have no database, the victims' database is used then
+	if len(databases) == 0 {
+		for _, p := range d.Processes {
+			if p.Victim && p.Database != "" {
+				databases[p.Database] = true
+			}
+		}
+	}
+	if len(databases) == 0 {
+		databases[""] = true
+	}
+
+	for db := range databases {
+		s.databases[db]++
+	}
+	for k := range objects {
+		if _, ok := s.objects[k]; !ok && len(s.objects) >= maxDeadlockObjects {
+			k = deadlockObjectKey{k.database, "other", ""}
+		}
+		s.objects[k]++
+	}
+}
+
+// Deadlocks returns the archived deadlock graphs, the most recent first.
+func (s *ScrapeDeadlock) Deadlocks() []Deadlock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Deadlock, len(s.archive))
+	for i, d := range s.archive {
+		result[len(s.archive)-1-i] = d
+	}
+	return result
+}
+
+// parseDeadlock parses the deadlock element of an xml_deadlock_report event,
+// names maps database ids to names.
+func parseDeadlock(report string, names map[int64]string) (Deadlock, error) {
+	var g deadlockGraph
+	err := xml.Unmarshal([]byte(report), &g)
+	if err != nil {
+		return Deadlock{}, err
+	}
+
+	var d Deadlock
+	victims := make(map[string]bool)
+	for _, v := range g.Victims {
+		d.Victims = append(d.Victims, v.ID)
+		victims[v.ID] = true
+	}
+
+	for _, p := range g.Processes {
+		db := p.CurrentDBName
+		if db == "" {
+			db = names[p.CurrentDB]
+		}
+		process := DeadlockProcess{
+			ID:              p.ID,
+			Victim:          victims[p.ID],
+			SessionID:       p.SPID,
+			Database:        db,
+			LoginName:       p.LoginName,
+			HostName:        p.HostName,
+			ClientApp:       p.ClientApp,
+			IsolationLevel:  p.IsolationLevel,
+			TransactionName: p.TransactionName,
+			LockMode:        p.LockMode,
+			WaitResource:    p.WaitResource,
+			WaitTimeMs:      p.WaitTime,
+			LogUsed:         p.LogUsed,
+			InputBuffer:     strings.TrimSpace(p.InputBuffer),
+		}
+		for _, f := range p.Frames {
+			// the text of a frame is only known while its plan is cached
+			text := strings.TrimSpace(f.Text)
+			if text == "" || text == "unknown" {
+				text = f.ProcName
+			}
+			if text != "" && text != "unknown" && text != "adhoc" {
+				process.Statements = append(process.Statements, text)
+			}
+		}
+		d.Processes = append(d.Processes, process)
+	}
+
+	for _, r := range g.Resources.Items {
+		resource := DeadlockResource{
+			Type:     r.XMLName.Local,
+			Database: names[r.DBID],
+			Index:    r.IndexName,
+			Mode:     r.Mode,
+			Owners:   r.Owners,
+			Waiters:  r.Waiters,
+		}
+		// objectname is database.schema.object
+		if parts := strings.SplitN(r.ObjectName, ".", 2); len(parts) == 2 {
+			resource.Database = parts[0]
+			resource.Object = parts[1]
+		} else {
+			resource.Object = r.ObjectName
+		}
+		d.Resources = append(d.Resources, resource)
+	}
+	return d, nil
+}
+
+type databaseIDRow struct {
+	DatabaseID int64  `db:"database_id"`
+	Name       string `db:"name"`
+}
+
+// databaseNames returns the names of the databases by id.
+func databaseNames(ctx context.Context, dbcli *dbutil.MSSQLClient) (map[int64]string, error) {
+	var rows []databaseIDRow
+	err := selectRows(ctx, dbcli, &rows, `SELECT database_id, name FROM sys.databases`)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string, len(rows))
+	for _, r := range rows {
+		names[r.DatabaseID] = r.Name
+	}
+	return names, nil
+}
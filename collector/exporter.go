@@ -3,8 +3,6 @@ package collector
 import (
 	"context"
 
-	"sync"
-
 	"github.com/prometheus/client_golang/prometheus"
 
 	"fmt"
@@ -19,29 +17,47 @@ const (
 )
 
 var (
-	dbConnectStatusDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, exporter, "db_connect_status"),
+	dbConnectStatusDesc = newDesc(exporter, "db_connect_status",
 		"Database Connect Status",
-		[]string{"message"}, nil)
+		[]string{"message"})
+
+	dbPoolOpenDesc = newDesc(exporter, "db_pool_open_connections",
+		"Number of established connections in the connection pool, both in use and idle.",
+		nil)
+
+	dbPoolInUseDesc = newDesc(exporter, "db_pool_in_use_connections",
+		"Number of connections of the connection pool currently in use.",
+		nil)
+
+	dbPoolIdleDesc = newDesc(exporter, "db_pool_idle_connections",
+		"Number of idle connections in the connection pool.",
+		nil)
+
+	dbPoolWaitCountDesc = newDesc(exporter, "db_pool_wait_count_total",
+		"Total number of connections waited for.",
+		nil)
+
+	dbPoolWaitDurationDesc = newDesc(exporter, "db_pool_wait_duration_seconds_total",
+		"Total time blocked waiting for a new connection.",
+		nil)
 )
 
 type Exporter struct {
 	ctx      context.Context
 	scrapers []Scraper
+	target   *Target
 	dbclient *dbutil.MSSQLClient
 	metrics  Metrics
 }
 
-func New(ctx context.Context, scrapers []Scraper, configFile string) *Exporter {
-	metrics := NewMetrics()
-
-	dbclient := dbutil.NewMSSQLClient(configFile)
-
+// New returns an exporter serving the most recent results of scrapers of target t.
+func New(ctx context.Context, t *Target, scrapers []Scraper) *Exporter {
 	exporter := Exporter{
 		ctx:      ctx,
 		scrapers: scrapers,
-		metrics:  metrics,
-		dbclient: dbclient}
+		metrics:  t.metrics,
+		target:   t,
+		dbclient: t.dbclient}
 
 	return &exporter
 }
@@ -50,78 +66,76 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.metrics.Error.Desc()
 	ch <- e.metrics.TotalScrapes.Desc()
 	e.metrics.ScrapeErrors.Describe(ch)
-	ch <- e.metrics.OracleUp.Desc()
-
+	ch <- e.metrics.Up.Desc()
+	e.metrics.CollectorDuration.Describe(ch)
+	e.metrics.CollectorSuccess.Describe(ch)
+	e.metrics.SkippedRows.Describe(ch)
+	ch <- dbPoolOpenDesc
+	ch <- dbPoolInUseDesc
+	ch <- dbPoolIdleDesc
+	ch <- dbPoolWaitCountDesc
+	ch <- dbPoolWaitDurationDesc
+	ch <- collectorDataAgeDesc
+	ch <- collectorSkippedDesc
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	// scrape each cdb
+	e.metrics.TotalScrapes.Inc()
 	e.scrape(e.ctx, ch)
 
 	ch <- e.metrics.Error
-	ch <- e.metrics.OracleUp
+	ch <- e.metrics.Up
 	ch <- e.metrics.TotalScrapes
 	e.metrics.ScrapeErrors.Collect(ch)
+	e.metrics.CollectorDuration.Collect(ch)
+	e.metrics.CollectorSuccess.Collect(ch)
+	e.metrics.SkippedRows.Collect(ch)
+
+	stats := e.dbclient.Stats()
+	ch <- prometheus.MustNewConstMetric(dbPoolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbPoolInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(dbPoolIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(dbPoolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbPoolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
 }
 
-// case 1: version < 12c
-// case 2: version >= 12c, with cdb and pdbs
-// case 3: version >= 12c, with pdbs, but no cdb
-// case 4: version >= 12c, no pdbs
-
 func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
 	var err error
 
-	err = e.dbclient.Init()
+	err = e.dbclient.Ping(ctx)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Can not Init DB Connection")
+		log.WithFields(log.Fields{"error": err, "target": e.target.Name}).Error("Can not Init DB Connection")
 		e.metrics.Error.Set(1)
-		e.metrics.OracleUp.Set(0)
-		ch <- prometheus.MustNewConstMetric(dbConnectStatusDesc, prometheus.GaugeValue, 1, fmt.Sprintf("%s", err))
+		e.metrics.Up.Set(0)
+		e.metrics.ScrapeErrors.WithLabelValues("connection").Inc()
+		ch <- prometheus.MustNewConstMetric(dbConnectStatusDesc, prometheus.GaugeValue, 1, e.dbclient.Redact(fmt.Sprintf("%s", err)))
 		return
 	}
+	e.metrics.Up.Set(1)
 
-	log.WithFields(log.Fields{"dbconfig": e.dbclient.C}).Info("DEBUG DB CONFIG")
+	log.WithFields(log.Fields{"dbconfig": e.dbclient.Config().String()}).Debug("DB Config")
 
 	ch <- prometheus.MustNewConstMetric(dbConnectStatusDesc, prometheus.GaugeValue, 0, "OK")
 
-	instanceInfo, err := getInstanceInfo(ctx, e.dbclient)
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Get Instance Info has error")
-		return
-	}
-
-	e.scrapeOne(ctx, ch, instanceInfo)
+	s, _ := e.target.current()
+	s.collect(ctx, ch, e.scrapers)
 
-	err = e.dbclient.CloseConnection()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Close Database Connection has error")
-	}
-
-}
-
-func (e *Exporter) scrapeOne(ctx context.Context, ch chan<- prometheus.Metric, oracleInfo *InstanceInfoAll) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	for _, scraper := range e.scrapers {
-		// if version < scraper.Version() {
-		// 	continue
-		// }
-
-		wg.Add(1)
-		go func(scraper Scraper) {
-			defer wg.Done()
-			scraper.Scrape(ctx, e.dbclient, ch, oracleInfo)
-		}(scraper)
+	if s.lastRunFailed(e.scrapers) {
+		e.metrics.Error.Set(1)
+	} else {
+		e.metrics.Error.Set(0)
 	}
 }
 
 // Metrics represents exporter metrics which values can be carried between http requests.
 type Metrics struct {
-	TotalScrapes prometheus.Counter
-	ScrapeErrors *prometheus.CounterVec
-	Error        prometheus.Gauge
-	OracleUp     prometheus.Gauge
+	TotalScrapes      prometheus.Counter
+	ScrapeErrors      *prometheus.CounterVec
+	Error             prometheus.Gauge
+	Up                prometheus.Gauge
+	CollectorDuration *prometheus.GaugeVec
+	CollectorSuccess  *prometheus.GaugeVec
+	SkippedRows       *prometheus.CounterVec
 }
 
 // NewMetrics creates new Metrics instance.
@@ -132,24 +146,42 @@ func NewMetrics() Metrics {
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "scrapes_total",
-			Help:      "Total number of times Oracle was scraped for metrics.",
+			Help:      "Total number of times SQL Server was scraped for metrics.",
 		}),
 		ScrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "scrape_errors_total",
-			Help:      "Total number of times an error occurred scraping a Oracle.",
+			Help:      "Total number of times an error occurred scraping a SQL Server.",
 		}, []string{"collector"}),
 		Error: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "last_scrape_error",
-			Help:      "Whether the last scrape of metrics from Oracle resulted in an error (1 for error, 0 for success).",
+			Help:      "Whether the last scrape of metrics from SQL Server resulted in an error (1 for error, 0 for success).",
 		}),
-		OracleUp: prometheus.NewGauge(prometheus.GaugeOpts{
+		Up: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "up",
-			Help:      "Whether the Oracle server is up.",
+			Help:      "Whether the SQL Server is up.",
 		}),
+		CollectorDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "collector_duration_seconds",
+			Help:      "Duration of the last run of a collector.",
+		}, []string{"collector"}),
+		CollectorSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "collector_success",
+			Help:      "Whether the last run of a collector succeeded (1 for success, 0 for error).",
+		}, []string{"collector"}),
+		SkippedRows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "collector_skipped_rows_total",
+			Help:      "Total number of malformed rows skipped by a collector.",
+		}, []string{"collector"}),
 	}
 }
@@ -0,0 +1,77 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+// fileSettingsRow is the size and growth settings of a database file in bytes,
+// the maximum size is -1 for unlimited growth.
+type fileSettingsRow struct {
+	DatabaseName    string  `db:"database_name"`
+	FileName        string  `db:"file_name"`
+	TypeDesc        string  `db:"type_desc,nullable"`
+	Size            float64 `db:"size"`
+	MaxSize         float64 `db:"max_size"`
+	Growth          float64 `db:"growth"`
+	IsPercentGrowth bool    `db:"is_percent_growth"`
+}
+
+// selectFileSettings returns the settings of the files of sys.master_files or sys.database_files
+// aliased f in from, which also filters them. database is the expression of the database name.
+func selectFileSettings(ctx context.Context, dbcli *dbutil.MSSQLClient, database, from string) ([]fileSettingsRow, error) {
+	// size, max_size and a fixed growth are in 8KB pages, max_size is -1 or 268435456 (2TB)
+	// for unlimited growth
+	sql := `SELECT ` + database + ` AS database_name, f.name AS file_name, f.type_desc,
+  CAST(f.size AS bigint) * 8192 AS size,
+  CASE WHEN f.max_size IN (-1, 268435456) THEN -1 ELSE CAST(f.max_size AS bigint) * 8192 END AS max_size,
+  CASE WHEN f.is_percent_growth = 1 THEN f.growth ELSE CAST(f.growth AS bigint) * 8192 END AS growth,
+  f.is_percent_growth
+` + from
+	var rows []fileSettingsRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// fileSettingsDescs are the metrics of the file settings of a subsystem.
+type fileSettingsDescs struct {
+	size          *prometheus.Desc
+	maxSize       *prometheus.Desc
+	growthBytes   *prometheus.Desc
+	growthPercent *prometheus.Desc
+}
+
+// newFileSettingsDescs returns the file settings metrics of subsystem, file names the kind of file in the help.
+func newFileSettingsDescs(subsystem, file string, labels []string) fileSettingsDescs {
+	return fileSettingsDescs{
+		size: newDesc(subsystem, "file_size_bytes",
+			"Current size of the "+file+".",
+			labels),
+		maxSize: newDesc(subsystem, "file_max_size_bytes",
+			"Maximum size of the "+file+", not reported for files with unlimited growth.",
+			labels),
+		growthBytes: newDesc(subsystem, "file_growth_bytes",
+			"Fixed growth increment of the "+file+", 0 when autogrowth is disabled.",
+			labels),
+		growthPercent: newDesc(subsystem, "file_growth_percent",
+			"Percent growth increment of the "+file+".",
+			labels),
+	}
+}
+
+func (d fileSettingsDescs) send(ch chan<- prometheus.Metric, r fileSettingsRow, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(d.size, prometheus.GaugeValue, r.Size, labels...)
+	if r.MaxSize >= 0 {
+		ch <- prometheus.MustNewConstMetric(d.maxSize, prometheus.GaugeValue, r.MaxSize, labels...)
+	}
+	if r.IsPercentGrowth {
+		ch <- prometheus.MustNewConstMetric(d.growthPercent, prometheus.GaugeValue, r.Growth, labels...)
+	} else {
+		ch <- prometheus.MustNewConstMetric(d.growthBytes, prometheus.GaugeValue, r.Growth, labels...)
+	}
+}
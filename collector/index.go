@@ -0,0 +1,252 @@
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	indexLimit = kingpin.Flag(
+		"collect.mssql_index.limit",
+		"Number of most used indexes per database exported by mssql_index.",
+	).Default("20").Int()
+
+	missingIndexLimit = kingpin.Flag(
+		"collect.mssql_index.missing-limit",
+		"Number of missing index suggestions with the highest estimated improvement exported by mssql_index.",
+	).Default("20").Int()
+
+	indexFragmentationMinPages = kingpin.Flag(
+		"collect.mssql_index_fragmentation.min-pages",
+		"Minimum page count of the indexes mssql_index_fragmentation reports.",
+	).Default("1000").Int()
+
+	indexLabels = []string{"database", "schema", "table", "index"}
+
+	indexUserSeeksDesc = newDesc("index", "user_seeks_total",
+		"Number of seeks by user queries on the index since the database started.",
+		indexLabels)
+
+	indexUserScansDesc = newDesc("index", "user_scans_total",
+		"Number of scans by user queries on the index since the database started.",
+		indexLabels)
+
+	indexUserLookupsDesc = newDesc("index", "user_lookups_total",
+		"Number of bookmark lookups by user queries on the index since the database started.",
+		indexLabels)
+
+	indexUserUpdatesDesc = newDesc("index", "user_updates_total",
+		"Number of updates by user queries on the index since the database started.",
+		indexLabels)
+
+	indexFragmentationDesc = newDesc("index", "fragmentation_percent",
+		"Logical fragmentation of the index, the highest of its partitions.",
+		indexLabels)
+
+	indexPagesDesc = newDesc("index", "pages",
+		"Number of in row data pages of the index.",
+		indexLabels)
+
+	missingIndexLabels = []string{"database", "table", "equality_columns", "inequality_columns", "included_columns"}
+
+	missingIndexImprovementDesc = newDesc("missing_index", "estimated_improvement",
+		"Estimated improvement of the missing index, the average query cost times the average impact times the seeks and scans.",
+		missingIndexLabels)
+
+	missingIndexUserImpactDesc = newDesc("missing_index", "avg_user_impact_percent",
+		"Average cost reduction of the user queries if the missing index was created.",
+		missingIndexLabels)
+
+	missingIndexUserSeeksDesc = newDesc("missing_index", "user_seeks_total",
+		"Number of seeks by user queries the missing index could have been used for.",
+		missingIndexLabels)
+
+	missingIndexUserScansDesc = newDesc("missing_index", "user_scans_total",
+		"Number of scans by user queries the missing index could have been used for.",
+		missingIndexLabels)
+
+	intervalIndex              = 5 * time.Minute
+	intervalIndexFragmentation = 6 * time.Hour
+)
+
+type indexUsageRow struct {
+	SchemaName  string  `db:"schema_name"`
+	TableName   string  `db:"table_name"`
+	IndexName   string  `db:"index_name"`
+	UserSeeks   float64 `db:"user_seeks"`
+	UserScans   float64 `db:"user_scans"`
+	UserLookups float64 `db:"user_lookups"`
+	UserUpdates float64 `db:"user_updates"`
+}
+
+type indexFragmentationRow struct {
+	SchemaName    string  `db:"schema_name"`
+	TableName     string  `db:"table_name"`
+	IndexName     string  `db:"index_name"`
+	Fragmentation float64 `db:"fragmentation"`
+	Pages         float64 `db:"pages"`
+}
+
+type missingIndexRow struct {
+	DatabaseName      string  `db:"database_name"`
+	TableName         string  `db:"table_name"`
+	EqualityColumns   string  `db:"equality_columns,nullable"`
+	InequalityColumns string  `db:"inequality_columns,nullable"`
+	IncludedColumns   string  `db:"included_columns,nullable"`
+	Improvement       float64 `db:"improvement"`
+	AvgUserImpact     float64 `db:"avg_user_impact"`
+	UserSeeks         float64 `db:"user_seeks"`
+	UserScans         float64 `db:"user_scans"`
+}
+
+// ScrapeIndex collects the usage of the most used indexes of every database and the
+// missing index suggestions of the optimizer.
+type ScrapeIndex struct{}
+
+func (ScrapeIndex) Name() string {
+	return "mssql_index"
+}
+
+func (ScrapeIndex) Help() string {
+	return "collect index usage of every user database and missing index suggestions"
+}
+
+func (ScrapeIndex) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeIndex) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	err := forEachDatabase(ctx, dbcli, s.Name(), func(db string) error {
+		return s.scrapeUsage(ctx, dbcli, ch, db)
+	})
+	if err != nil {
+		return err
+	}
+	return s.scrapeMissing(ctx, dbcli, ch)
+}
+
+func (s *ScrapeIndex) scrapeUsage(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, db string) error {
+	// heaps have no name and are left out, indexes never used since the database started
+	// have no usage row
+	sql := `SELECT TOP (@p1) s.name AS schema_name, o.name AS table_name, i.name AS index_name,
+  ISNULL(us.user_seeks, 0) AS user_seeks, ISNULL(us.user_scans, 0) AS user_scans,
+  ISNULL(us.user_lookups, 0) AS user_lookups, ISNULL(us.user_updates, 0) AS user_updates
+FROM sys.indexes i
+JOIN sys.objects o ON o.object_id = i.object_id
+JOIN sys.schemas s ON s.schema_id = o.schema_id
+LEFT JOIN sys.dm_db_index_usage_stats us
+  ON us.database_id = DB_ID() AND us.object_id = i.object_id AND us.index_id = i.index_id
+WHERE i.index_id > 0 AND o.is_ms_shipped = 0 AND o.type IN ('U', 'V')
+ORDER BY ISNULL(us.user_seeks + us.user_scans + us.user_lookups + us.user_updates, 0) DESC
+`
+	var rows []indexUsageRow
+	err := selectRows(ctx, dbcli, &rows, dbutil.InDatabase(db, sql), *indexLimit)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		labels := []string{db, r.SchemaName, r.TableName, r.IndexName}
+		ch <- prometheus.MustNewConstMetric(indexUserSeeksDesc, prometheus.CounterValue, r.UserSeeks, labels...)
+		ch <- prometheus.MustNewConstMetric(indexUserScansDesc, prometheus.CounterValue, r.UserScans, labels...)
+		ch <- prometheus.MustNewConstMetric(indexUserLookupsDesc, prometheus.CounterValue, r.UserLookups, labels...)
+		ch <- prometheus.MustNewConstMetric(indexUserUpdatesDesc, prometheus.CounterValue, r.UserUpdates, labels...)
+	}
+	return nil
+}
+
+func (s *ScrapeIndex) scrapeMissing(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// the suggestions of all databases are ranked together, the limit is applied after the
+	// database filter so it is not taken by databases which are not monitored
+	sql := `SELECT DB_NAME(d.database_id) AS database_name, d.statement AS table_name,
+  d.equality_columns, d.inequality_columns, d.included_columns,
+  gs.avg_total_user_cost * gs.avg_user_impact / 100 * (gs.user_seeks + gs.user_scans) AS improvement,
+  gs.avg_user_impact, gs.user_seeks, gs.user_scans
+FROM sys.dm_db_missing_index_details d
+JOIN sys.dm_db_missing_index_groups g ON g.index_handle = d.index_handle
+JOIN sys.dm_db_missing_index_group_stats gs ON gs.group_handle = g.index_group_handle
+WHERE d.database_id > 4 AND DB_NAME(d.database_id) IS NOT NULL
+ORDER BY improvement DESC
+`
+	var rows []missingIndexRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	// the same suggestion may be in several groups, only the one with the highest
+	// improvement is kept
+	seen := make(map[[5]string]bool)
+	for _, r := range rows {
+		if len(seen) >= *missingIndexLimit {
+			break
+		}
+		key := [5]string{r.DatabaseName, r.TableName, r.EqualityColumns, r.InequalityColumns, r.IncludedColumns}
+		if seen[key] || !databaseSelected(r.DatabaseName) {
+			continue
+		}
+		seen[key] = true
+
+		labels := key[:]
+		ch <- prometheus.MustNewConstMetric(missingIndexImprovementDesc, prometheus.GaugeValue, r.Improvement, labels...)
+		ch <- prometheus.MustNewConstMetric(missingIndexUserImpactDesc, prometheus.GaugeValue, r.AvgUserImpact, labels...)
+		ch <- prometheus.MustNewConstMetric(missingIndexUserSeeksDesc, prometheus.CounterValue, r.UserSeeks, labels...)
+		ch <- prometheus.MustNewConstMetric(missingIndexUserScansDesc, prometheus.CounterValue, r.UserScans, labels...)
+	}
+	return nil
+}
+
+// ScrapeIndexFragmentation collects the fragmentation of the large indexes of every database,
+// sys.dm_db_index_physical_stats reads the index pages so it runs on a slow interval.
+type ScrapeIndexFragmentation struct{}
+
+func (ScrapeIndexFragmentation) Name() string {
+	return "mssql_index_fragmentation"
+}
+
+func (ScrapeIndexFragmentation) Help() string {
+	return "collect fragmentation of large indexes of every user database in LIMITED mode"
+}
+
+func (ScrapeIndexFragmentation) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeIndexFragmentation) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// small indexes are left out by their page count in sys.dm_db_partition_stats before
+	// reading their physical stats
+	sql := `SELECT s.name AS schema_name, o.name AS table_name, i.name AS index_name,
+  MAX(ps.avg_fragmentation_in_percent) AS fragmentation, SUM(ps.page_count) AS pages
+FROM (
+  SELECT object_id, index_id
+  FROM sys.dm_db_partition_stats
+  WHERE index_id > 0
+  GROUP BY object_id, index_id
+  HAVING SUM(in_row_data_page_count) >= @p1
+) large
+JOIN sys.indexes i ON i.object_id = large.object_id AND i.index_id = large.index_id
+JOIN sys.objects o ON o.object_id = i.object_id
+JOIN sys.schemas s ON s.schema_id = o.schema_id
+CROSS APPLY sys.dm_db_index_physical_stats(DB_ID(), large.object_id, large.index_id, NULL, 'LIMITED') ps
+WHERE o.is_ms_shipped = 0 AND ps.alloc_unit_type_desc = 'IN_ROW_DATA'
+GROUP BY s.name, o.name, i.name
+`
+	return forEachDatabase(ctx, dbcli, s.Name(), func(db string) error {
+		var rows []indexFragmentationRow
+		err := selectRows(ctx, dbcli, &rows, dbutil.InDatabase(db, sql), *indexFragmentationMinPages)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rows {
+			labels := []string{db, r.SchemaName, r.TableName, r.IndexName}
+			ch <- prometheus.MustNewConstMetric(indexFragmentationDesc, prometheus.GaugeValue, r.Fragmentation, labels...)
+			ch <- prometheus.MustNewConstMetric(indexPagesDesc, prometheus.GaugeValue, r.Pages, labels...)
+		}
+		return nil
+	})
+}
@@ -16,10 +16,9 @@ var (
 		"collation", "is_clustered", "is_fulltext_installed", "is_integrated_security_only",
 		"is_hadr_enabled", "hadr_manager_status"}
 
-	mssqlInfoDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "instance", "info"),
+	mssqlInfoDesc = newDesc("instance", "info",
 		"MSSQL Instance Info",
-		instanceInfoCols, nil)
+		instanceInfoCols)
 )
 
 type ScrapeMSSQLInfo struct{}
@@ -34,7 +33,7 @@ func (ScrapeMSSQLInfo) Help() string {
 }
 
 func (ScrapeMSSQLInfo) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (ScrapeMSSQLInfo) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
@@ -2,27 +2,109 @@ package collector
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	// log "github.com/sirupsen/logrus"
 	"yunche.pro/dtsre/mssql_exporter/dbutil"
 )
 
 type InstanceInfoAll struct {
-	Version                  string
-	MachineName              string
-	ServerName               string
-	InstanceName             string
-	ComputerName             string
-	Edition                  string
-	ProductLevel             string
-	ProductionVersion        string
-	Collation                string
-	IsClustered              int64
-	IsFullTextInstalled      int64
-	IsIntegratedSecurityOnly int64
-	IsHadrEnabled            int64
-	HadrManagerStatus        int64
-	VersionNum               float64
+	Version                  string        `db:"version"`
+	MachineName              string        `db:"machinename,nullable"`
+	ServerName               string        `db:"servername,nullable"`
+	InstanceName             string        `db:"instance,nullable"`
+	ComputerName             string        `db:"computernamephysicalnetbios,nullable"`
+	Edition                  string        `db:"edition"`
+	ProductLevel             string        `db:"productlevel,nullable"`
+	ProductionVersion        string        `db:"productversion"`
+	Collation                string        `db:"collation,nullable"`
+	IsClustered              int64         `db:"isclustered,nullable"`
+	IsFullTextInstalled      int64         `db:"isfulltextinstalled,nullable"`
+	IsIntegratedSecurityOnly int64         `db:"isintegratedsecurityonly,nullable"`
+	IsHadrEnabled            int64         `db:"ishadrenabled,nullable"`
+	HadrManagerStatus        int64         `db:"hadrmanagerstatus,nullable"`
+	VersionNum               float64       `db:"-"`
+	ServerVersion            ServerVersion `db:"-"`
+}
+
+// ServerVersion is the parsed SERVERPROPERTY('ProductVersion'), e.g. 13.0.5026.0.
+type ServerVersion struct {
+	Major    int
+	Minor    int
+	Build    int
+	Revision int
+}
+
+var versionNames = map[[2]int]string{
+	{10, 0}:  "2008",
+	{10, 50}: "2008R2",
+	{11, 0}:  "2012",
+	{12, 0}:  "2014",
+	{13, 0}:  "2016",
+	{14, 0}:  "2017",
+	{15, 0}:  "2019",
+	{16, 0}:  "2022",
+}
+
+func parseServerVersion(vs string) (ServerVersion, error) {
+	var v ServerVersion
+	elems := strings.Split(strings.TrimSpace(vs), ".")
+	if len(elems) < 2 {
+		return v, fmt.Errorf("invalid product version %q", vs)
+	}
+
+	parts := []*int{&v.Major, &v.Minor, &v.Build, &v.Revision}
+	for i, e := range elems {
+		if i >= len(parts) {
+			break
+		}
+		n, err := strconv.Atoi(e)
+		if err != nil {
+			return v, fmt.Errorf("invalid product version %q", vs)
+		}
+		*parts[i] = n
+	}
+	return v, nil
+}
+
+// Name returns the release name of the version, e.g. 2008R2, 2016.
+func (v ServerVersion) Name() string {
+	if name, ok := versionNames[[2]int{v.Major, v.Minor}]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// AtLeast reports whether the version is major.minor or newer.
+func (v ServerVersion) AtLeast(major, minor int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	return v.Minor >= minor
+}
+
+// AtLeastRelease reports whether the version is release or newer, release is major.minor as in
+// Scraper.Version, e.g. 10.5 for 10.50. It is split into major and minor instead of compared
+// as float, which would order 10.50 before 10.9.
+func (v ServerVersion) AtLeastRelease(release float64) bool {
+	major := math.Floor(release)
+	minor := math.Round((release - major) * 100)
+	return v.AtLeast(int(major), int(minor))
+}
+
+// AtLeastBuild reports whether the version is major.minor.build or newer.
+func (v ServerVersion) AtLeastBuild(major, minor, build int) bool {
+	if v.Major != major || v.Minor != minor {
+		return v.AtLeast(major, minor)
+	}
+	return v.Build >= build
+}
+
+func (v ServerVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Build, v.Revision)
 }
 
 func getInstanceInfo(ctx context.Context, dbcli *dbutil.MSSQLClient) (*InstanceInfoAll, error) {
@@ -41,27 +123,23 @@ SERVERPROPERTY('IsIntegratedSecurityOnly') AS [IsIntegratedSecurityOnly],
 SERVERPROPERTY('IsHadrEnabled') AS [IsHadrEnabled],
 SERVERPROPERTY('HadrManagerStatus') AS [HadrManagerStatus]
 `
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []InstanceInfoAll
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
 		return nil, err
 	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no instance info returned")
+	}
 
-	inst := InstanceInfoAll{}
-	r := rows[0]
-	inst.Version = r[0].(string)
-	inst.MachineName = r[1].(string)
-	inst.ServerName = r[2].(string)
-	inst.InstanceName = r[3].(string)
-	inst.ComputerName = r[4].(string)
-	inst.Edition = r[5].(string)
-	inst.ProductLevel = r[6].(string)
-	inst.ProductionVersion = r[7].(string)
-	inst.Collation = r[8].(string)
-	inst.IsClustered = r[9].(int64)
-	inst.IsFullTextInstalled = r[10].(int64)
-	inst.IsIntegratedSecurityOnly = r[11].(int64)
-	inst.IsHadrEnabled = r[12].(int64)
-	inst.HadrManagerStatus = r[13].(int64)
-	inst.VersionNum = 0.0
+	inst := rows[0]
+	inst.ServerVersion, err = parseServerVersion(inst.ProductionVersion)
+	if err != nil {
+		return nil, err
+	}
+	inst.VersionNum, err = parseVersion(inst.ProductionVersion)
+	if err != nil {
+		return nil, err
+	}
 	return &inst, nil
 }
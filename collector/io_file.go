@@ -0,0 +1,137 @@
+package collector
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	ioFileLabels = []string{"database", "file", "type", "drive"}
+
+	ioFileReadsDesc = newDesc("io_file", "reads_total",
+		"Number of reads issued on the database file.",
+		ioFileLabels)
+
+	ioFileWritesDesc = newDesc("io_file", "writes_total",
+		"Number of writes issued on the database file.",
+		ioFileLabels)
+
+	ioFileReadBytesDesc = newDesc("io_file", "read_bytes_total",
+		"Number of bytes read from the database file.",
+		ioFileLabels)
+
+	ioFileWrittenBytesDesc = newDesc("io_file", "written_bytes_total",
+		"Number of bytes written to the database file.",
+		ioFileLabels)
+
+	ioFileReadStallDesc = newDesc("io_file", "read_stall_seconds_total",
+		"Total time users waited for reads on the database file.",
+		ioFileLabels)
+
+	ioFileWriteStallDesc = newDesc("io_file", "write_stall_seconds_total",
+		"Total time users waited for writes on the database file.",
+		ioFileLabels)
+
+	ioFileQueuedReadStallDesc = newDesc("io_file", "queued_read_stall_seconds_total",
+		"Total read stall introduced by IO resource governance on the database file.",
+		ioFileLabels)
+
+	ioFileQueuedWriteStallDesc = newDesc("io_file", "queued_write_stall_seconds_total",
+		"Total write stall introduced by IO resource governance on the database file.",
+		ioFileLabels)
+
+	ioFileSizeDesc = newDesc("io_file", "size_on_disk_bytes",
+		"Size of the database file on disk.",
+		ioFileLabels)
+)
+
+type ioFileRow struct {
+	DatabaseName      string   `db:"database_name,nullable"`
+	FileName          string   `db:"file_name"`
+	TypeDesc          string   `db:"type_desc,nullable"`
+	PhysicalName      string   `db:"physical_name,nullable"`
+	NumOfReads        float64  `db:"num_of_reads"`
+	NumOfWrites       float64  `db:"num_of_writes"`
+	NumOfBytesRead    float64  `db:"num_of_bytes_read"`
+	NumOfBytesWritten float64  `db:"num_of_bytes_written"`
+	IoStallReadMs     float64  `db:"io_stall_read_ms"`
+	IoStallWriteMs    float64  `db:"io_stall_write_ms"`
+	QueuedReadMs      *float64 `db:"io_stall_queued_read_ms"`
+	QueuedWriteMs     *float64 `db:"io_stall_queued_write_ms"`
+	SizeOnDiskBytes   float64  `db:"size_on_disk_bytes"`
+}
+
+// ScrapeIOFile collects the cumulative IO statistics of every database file.
+type ScrapeIOFile struct{}
+
+func (ScrapeIOFile) Name() string {
+	return "mssql_io_file"
+}
+
+func (ScrapeIOFile) Help() string {
+	return "collect database file IO statistics from sys.dm_io_virtual_file_stats"
+}
+
+func (ScrapeIOFile) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeIOFile) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// queued stalls of IO resource governance are available from 2014
+	queued := "vfs.io_stall_queued_read_ms, vfs.io_stall_queued_write_ms"
+	if !ins.ServerVersion.AtLeast(12, 0) {
+		queued = "NULL AS io_stall_queued_read_ms, NULL AS io_stall_queued_write_ms"
+	}
+
+	sql := `SELECT DB_NAME(vfs.database_id) AS database_name, mf.name AS file_name, mf.type_desc, mf.physical_name,
+  vfs.num_of_reads, vfs.num_of_writes, vfs.num_of_bytes_read, vfs.num_of_bytes_written,
+  vfs.io_stall_read_ms, vfs.io_stall_write_ms, ` + queued + `, vfs.size_on_disk_bytes
+FROM sys.dm_io_virtual_file_stats(NULL, NULL) vfs
+JOIN sys.master_files mf ON mf.database_id = vfs.database_id AND mf.file_id = vfs.file_id
+`
+	var rows []ioFileRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		labels := []string{r.DatabaseName, r.FileName, r.TypeDesc, driveOf(r.PhysicalName)}
+		ch <- prometheus.MustNewConstMetric(ioFileReadsDesc, prometheus.CounterValue, r.NumOfReads, labels...)
+		ch <- prometheus.MustNewConstMetric(ioFileWritesDesc, prometheus.CounterValue, r.NumOfWrites, labels...)
+		ch <- prometheus.MustNewConstMetric(ioFileReadBytesDesc, prometheus.CounterValue, r.NumOfBytesRead, labels...)
+		ch <- prometheus.MustNewConstMetric(ioFileWrittenBytesDesc, prometheus.CounterValue, r.NumOfBytesWritten, labels...)
+		ch <- prometheus.MustNewConstMetric(ioFileReadStallDesc, prometheus.CounterValue, r.IoStallReadMs/1000, labels...)
+		ch <- prometheus.MustNewConstMetric(ioFileWriteStallDesc, prometheus.CounterValue, r.IoStallWriteMs/1000, labels...)
+		if r.QueuedReadMs != nil {
+			ch <- prometheus.MustNewConstMetric(ioFileQueuedReadStallDesc, prometheus.CounterValue, *r.QueuedReadMs/1000, labels...)
+		}
+		if r.QueuedWriteMs != nil {
+			ch <- prometheus.MustNewConstMetric(ioFileQueuedWriteStallDesc, prometheus.CounterValue, *r.QueuedWriteMs/1000, labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(ioFileSizeDesc, prometheus.GaugeValue, r.SizeOnDiskBytes, labels...)
+	}
+	return nil
+}
+
+// driveOf returns the drive of a database file, the drive letter on Windows,
+// the share of a UNC path, or the top level directory on Linux.
+func driveOf(path string) string {
+	switch {
+	case len(path) >= 2 && path[1] == ':':
+		return strings.ToUpper(path[:2])
+	case strings.HasPrefix(path, `\\`):
+		parts := strings.SplitN(path[2:], `\`, 3)
+		if len(parts) >= 2 {
+			return `\\` + parts[0] + `\` + parts[1]
+		}
+		return path
+	case strings.HasPrefix(path, "/"):
+		parts := strings.SplitN(path[1:], "/", 2)
+		return "/" + parts[0]
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+package collector
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	memoryClerkLimit = kingpin.Flag(
+		"collect.mssql_memory.clerk-limit",
+		"Number of largest memory clerk types exported by mssql_memory, the others are summed up with clerk \"other\".",
+	).Default("10").Int()
+
+	memoryClerkDesc = newDesc("memory", "clerk_bytes",
+		"Memory allocated by the memory clerks of the type.",
+		[]string{"clerk"})
+
+	memoryProcessPhysicalDesc = newDesc("memory", "process_physical_bytes",
+		"Physical memory in use by the SQL Server process, including large and locked pages.",
+		nil)
+
+	memoryProcessLockedDesc = newDesc("memory", "process_locked_pages_bytes",
+		"Memory allocated by the SQL Server process with locked pages.",
+		nil)
+
+	memoryProcessVirtualCommittedDesc = newDesc("memory", "process_virtual_committed_bytes",
+		"Virtual memory committed by the SQL Server process.",
+		nil)
+
+	memoryProcessUtilizationDesc = newDesc("memory", "process_utilization_percent",
+		"Committed memory of the SQL Server process in the working set, in percent.",
+		nil)
+
+	memoryProcessPageFaultsDesc = newDesc("memory", "process_page_faults_total",
+		"Page faults incurred by the SQL Server process.",
+		nil)
+
+	memoryProcessPhysicalLowDesc = newDesc("memory", "process_physical_memory_low",
+		"Whether the SQL Server process is notified of low physical memory.",
+		nil)
+
+	memoryProcessVirtualLowDesc = newDesc("memory", "process_virtual_memory_low",
+		"Whether the SQL Server process is notified of low virtual memory.",
+		nil)
+
+	memoryOSTotalDesc = newDesc("memory", "os_total_bytes",
+		"Physical memory of the operating system.",
+		nil)
+
+	memoryOSAvailableDesc = newDesc("memory", "os_available_bytes",
+		"Available physical memory of the operating system.",
+		nil)
+
+	memoryOSPageFileTotalDesc = newDesc("memory", "os_page_file_total_bytes",
+		"Commit limit of the operating system.",
+		nil)
+
+	memoryOSPageFileAvailableDesc = newDesc("memory", "os_page_file_available_bytes",
+		"Page file space not in use.",
+		nil)
+
+	memoryOSStateDesc = newDesc("memory", "os_state",
+		"System memory state of the operating system, 1 for the current state.",
+		[]string{"state"})
+
+	memoryOSStates = []string{"high", "low", "steady", "transitioning"}
+
+	memoryPhysicalDesc = newDesc("memory", "physical_bytes",
+		"Physical memory visible to SQL Server, the container or memory.memorylimitmb limit on Linux.",
+		nil)
+
+	memoryCommittedDesc = newDesc("memory", "committed_bytes",
+		"Memory committed by the memory manager.",
+		nil)
+
+	memoryCommittedTargetDesc = newDesc("memory", "committed_target_bytes",
+		"Memory the memory manager targets to commit.",
+		nil)
+
+	sysInfoCPUCountDesc = newDesc("sys_info", "cpu_count",
+		"Number of logical CPUs visible to SQL Server, the container limit on Linux.",
+		nil)
+
+	sysInfoSchedulerCountDesc = newDesc("sys_info", "scheduler_count",
+		"Number of user schedulers of the SQL Server process.",
+		nil)
+
+	sysInfoHyperthreadRatioDesc = newDesc("sys_info", "hyperthread_ratio",
+		"Number of logical CPUs per physical processor.",
+		nil)
+)
+
+type memoryClerkRow struct {
+	Type  string  `db:"type"`
+	Bytes float64 `db:"bytes"`
+}
+
+type processMemoryRow struct {
+	PhysicalMemoryInUse      float64 `db:"physical_memory_in_use"`
+	LockedPageAllocations    float64 `db:"locked_page_allocations"`
+	VirtualMemoryCommitted   float64 `db:"virtual_memory_committed"`
+	MemoryUtilization        float64 `db:"memory_utilization_percentage"`
+	PageFaultCount           float64 `db:"page_fault_count"`
+	ProcessPhysicalMemoryLow bool    `db:"process_physical_memory_low"`
+	ProcessVirtualMemoryLow  bool    `db:"process_virtual_memory_low"`
+}
+
+type sysMemoryRow struct {
+	TotalPhysicalMemory     float64 `db:"total_physical_memory"`
+	AvailablePhysicalMemory float64 `db:"available_physical_memory"`
+	TotalPageFile           float64 `db:"total_page_file"`
+	AvailablePageFile       float64 `db:"available_page_file"`
+	HighMemorySignal        bool    `db:"system_high_memory_signal_state"`
+	LowMemorySignal         bool    `db:"system_low_memory_signal_state"`
+}
+
+type sysInfoRow struct {
+	CPUCount         float64 `db:"cpu_count"`
+	SchedulerCount   float64 `db:"scheduler_count"`
+	HyperthreadRatio float64 `db:"hyperthread_ratio"`
+	PhysicalMemory   float64 `db:"physical_memory"`
+	Committed        float64 `db:"committed"`
+	CommittedTarget  float64 `db:"committed_target"`
+}
+
+// ScrapeMemory collects the memory clerks, the memory of the SQL Server process and of the operating system.
+type ScrapeMemory struct{}
+
+func (ScrapeMemory) Name() string {
+	return "mssql_memory"
+}
+
+func (ScrapeMemory) Help() string {
+	return "collect memory clerks, process memory, OS memory and sys info"
+}
+
+func (ScrapeMemory) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeMemory) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	// the memory manager was reworked in 2012, single and multi page allocations were
+	// merged into pages_kb and the buffer pool columns of sys.dm_os_sys_info were replaced
+	v11 := ins.ServerVersion.AtLeast(11, 0)
+
+	err := s.scrapeClerks(ctx, dbcli, ch, v11)
+	if err != nil {
+		return err
+	}
+	err = s.scrapeProcess(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+	err = s.scrapeOS(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+	return s.scrapeSysInfo(ctx, dbcli, ch, v11)
+}
+
+func (s *ScrapeMemory) scrapeClerks(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, v11 bool) error {
+	sql := `SELECT type, SUM(CAST(pages_kb AS bigint)) * 1024 AS bytes FROM sys.dm_os_memory_clerks GROUP BY type`
+	if !v11 {
+		sql = `SELECT type, SUM(CAST(single_pages_kb + multi_pages_kb + virtual_memory_committed_kb + awe_allocated_kb AS bigint)) * 1024 AS bytes
+FROM sys.dm_os_memory_clerks GROUP BY type`
+	}
+	var rows []memoryClerkRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Bytes > rows[j].Bytes
+	})
+	other := 0.0
+	for i, r := range rows {
+		if i >= *memoryClerkLimit {
+			other += r.Bytes
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(memoryClerkDesc, prometheus.GaugeValue, r.Bytes, r.Type)
+	}
+	if len(rows) > *memoryClerkLimit {
+		ch <- prometheus.MustNewConstMetric(memoryClerkDesc, prometheus.GaugeValue, other, "other")
+	}
+	return nil
+}
+
+func (s *ScrapeMemory) scrapeProcess(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	sql := `SELECT physical_memory_in_use_kb * 1024 AS physical_memory_in_use,
+  locked_page_allocations_kb * 1024 AS locked_page_allocations,
+  virtual_address_space_committed_kb * 1024 AS virtual_memory_committed,
+  memory_utilization_percentage, page_fault_count,
+  process_physical_memory_low, process_virtual_memory_low
+FROM sys.dm_os_process_memory`
+	var rows []processMemoryRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		ch <- prometheus.MustNewConstMetric(memoryProcessPhysicalDesc, prometheus.GaugeValue, r.PhysicalMemoryInUse)
+		ch <- prometheus.MustNewConstMetric(memoryProcessLockedDesc, prometheus.GaugeValue, r.LockedPageAllocations)
+		ch <- prometheus.MustNewConstMetric(memoryProcessVirtualCommittedDesc, prometheus.GaugeValue, r.VirtualMemoryCommitted)
+		ch <- prometheus.MustNewConstMetric(memoryProcessUtilizationDesc, prometheus.GaugeValue, r.MemoryUtilization)
+		ch <- prometheus.MustNewConstMetric(memoryProcessPageFaultsDesc, prometheus.CounterValue, r.PageFaultCount)
+		ch <- prometheus.MustNewConstMetric(memoryProcessPhysicalLowDesc, prometheus.GaugeValue, boolToFloat(r.ProcessPhysicalMemoryLow))
+		ch <- prometheus.MustNewConstMetric(memoryProcessVirtualLowDesc, prometheus.GaugeValue, boolToFloat(r.ProcessVirtualMemoryLow))
+	}
+	return nil
+}
+
+func (s *ScrapeMemory) scrapeOS(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	sql := `SELECT total_physical_memory_kb * 1024 AS total_physical_memory,
+  available_physical_memory_kb * 1024 AS available_physical_memory,
+  total_page_file_kb * 1024 AS total_page_file,
+  available_page_file_kb * 1024 AS available_page_file,
+  system_high_memory_signal_state, system_low_memory_signal_state
+FROM sys.dm_os_sys_memory`
+	var rows []sysMemoryRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		ch <- prometheus.MustNewConstMetric(memoryOSTotalDesc, prometheus.GaugeValue, r.TotalPhysicalMemory)
+		ch <- prometheus.MustNewConstMetric(memoryOSAvailableDesc, prometheus.GaugeValue, r.AvailablePhysicalMemory)
+		ch <- prometheus.MustNewConstMetric(memoryOSPageFileTotalDesc, prometheus.GaugeValue, r.TotalPageFile)
+		ch <- prometheus.MustNewConstMetric(memoryOSPageFileAvailableDesc, prometheus.GaugeValue, r.AvailablePageFile)
+
+		// the states of system_memory_state_desc, told apart by the two signals
+		state := "steady"
+		switch {
+		case r.HighMemorySignal && r.LowMemorySignal:
+			state = "transitioning"
+		case r.HighMemorySignal:
+			state = "high"
+		case r.LowMemorySignal:
+			state = "low"
+		}
+		sendStateSet(ch, memoryOSStateDesc, memoryOSStates, state)
+	}
+	return nil
+}
+
+func (s *ScrapeMemory) scrapeSysInfo(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, v11 bool) error {
+	sql := `SELECT cpu_count, scheduler_count, hyperthread_ratio,
+  physical_memory_kb * 1024 AS physical_memory,
+  committed_kb * 1024 AS committed,
+  committed_target_kb * 1024 AS committed_target
+FROM sys.dm_os_sys_info`
+	if !v11 {
+		sql = `SELECT cpu_count, scheduler_count, hyperthread_ratio,
+  physical_memory_in_bytes AS physical_memory,
+  CAST(bpool_committed AS bigint) * 8192 AS committed,
+  CAST(bpool_commit_target AS bigint) * 8192 AS committed_target
+FROM sys.dm_os_sys_info`
+	}
+	var rows []sysInfoRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		ch <- prometheus.MustNewConstMetric(memoryPhysicalDesc, prometheus.GaugeValue, r.PhysicalMemory)
+		ch <- prometheus.MustNewConstMetric(memoryCommittedDesc, prometheus.GaugeValue, r.Committed)
+		ch <- prometheus.MustNewConstMetric(memoryCommittedTargetDesc, prometheus.GaugeValue, r.CommittedTarget)
+		ch <- prometheus.MustNewConstMetric(sysInfoCPUCountDesc, prometheus.GaugeValue, r.CPUCount)
+		ch <- prometheus.MustNewConstMetric(sysInfoSchedulerCountDesc, prometheus.GaugeValue, r.SchedulerCount)
+		ch <- prometheus.MustNewConstMetric(sysInfoHyperthreadRatioDesc, prometheus.GaugeValue, r.HyperthreadRatio)
+	}
+	return nil
+}
@@ -17,23 +17,29 @@ var (
 		"witness_name",
 	}
 
-	dbMirrorStateDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "mirror", "partner_state"),
+	dbMirrorStateDesc = newDesc("mirror", "partner_state",
 		"MSSQL Database Mirror State",
-		dbMirrorStateCols, nil)
+		dbMirrorStateCols)
 
-	dbWitnessStateDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "mirror", "witness_state"),
+	dbWitnessStateDesc = newDesc("mirror", "witness_state",
 		"MSSQL Database Witness State",
-		dbMirrorStateCols, nil)
+		dbMirrorStateCols)
 
 	intervalDbMirrorState = 5 * time.Second
 )
 
-type ScrapeDbMirrorState struct {
-	lastTime time.Time
+type dbMirrorStateRow struct {
+	DbName         string  `db:"db_name"`
+	Role           string  `db:"mirroring_role_desc,nullable"`
+	SafetyLevel    string  `db:"mirroring_safety_level_desc,nullable"`
+	PartnerName    string  `db:"mirroring_partner_name,nullable"`
+	WitnessName    *string `db:"mirroring_witness_name"`
+	MirroringState int64   `db:"mirroring_state,nullable"`
+	WitnessState   int64   `db:"mirroring_witness_state,nullable"`
 }
 
+type ScrapeDbMirrorState struct{}
+
 func (ScrapeDbMirrorState) Name() string {
 	return "mssql_mirror_status"
 }
@@ -44,16 +50,11 @@ func (ScrapeDbMirrorState) Help() string {
 }
 
 func (ScrapeDbMirrorState) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeDbMirrorState) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
-	duration := time.Since(s.lastTime)
-	if duration < intervalDbMirrorState {
-		return nil
-	}
-
-	sql := `select  db_name(database_id), 
+	sql := `select  db_name(database_id) db_name, 
 	mirroring_role_desc,
 	mirroring_safety_level_desc, 
 	mirroring_partner_name, 
@@ -64,40 +65,41 @@ from sys.database_mirroring
 where mirroring_partner_name is not null
 	`
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []dbMirrorStateRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	currentTime := time.Now()
-
 	for _, r := range rows {
+		witnessName := ""
+		if r.WitnessName != nil {
+			witnessName = *r.WitnessName
+		}
 
 		ch <- prometheus.MustNewConstMetric(
-			dbMirrorStateDesc, prometheus.GaugeValue, float64(r[5].(int64)),
-			r[0].(string),
-			r[1].(string),
-			r[2].(string),
-			r[3].(string),
-			formatNullableString(r[4].(string)),
+			dbMirrorStateDesc, prometheus.GaugeValue, float64(r.MirroringState),
+			r.DbName,
+			r.Role,
+			r.SafetyLevel,
+			r.PartnerName,
+			witnessName,
 		)
 
 		// witness is not null
-		if r[4] != nil {
+		if r.WitnessName != nil {
 
 			ch <- prometheus.MustNewConstMetric(
-				dbWitnessStateDesc, prometheus.GaugeValue, float64(r[6].(int64)),
-				r[0].(string),
-				r[1].(string),
-				r[2].(string),
-				r[3].(string),
-				r[4].(string),
+				dbWitnessStateDesc, prometheus.GaugeValue, float64(r.WitnessState),
+				r.DbName,
+				r.Role,
+				r.SafetyLevel,
+				r.PartnerName,
+				witnessName,
 			)
 		}
 
 	}
 
-	s.lastTime = currentTime
-
 	return nil
 }
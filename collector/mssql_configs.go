@@ -9,12 +9,16 @@ import (
 )
 
 var (
-	mssqlConfigDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "configuration", "value"),
+	mssqlConfigDesc = newDesc("configuration", "value",
 		"MSSQL Configuration Info",
-		[]string{"name"}, nil)
+		[]string{"name"})
 )
 
+type mssqlConfigRow struct {
+	Name       string  `db:"name"`
+	ValueInUse float64 `db:"value_in_use"`
+}
+
 type ScrapeMSSQLConfig struct {
 	lastTime time.Time
 }
@@ -29,7 +33,7 @@ func (ScrapeMSSQLConfig) Help() string {
 }
 
 func (ScrapeMSSQLConfig) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeMSSQLConfig) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
@@ -54,15 +58,16 @@ where name in (
 )
 `
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []mssqlConfigRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	for _, r := range rows {
 
 		ch <- prometheus.MustNewConstMetric(
-			mssqlConfigDesc, prometheus.GaugeValue, float64(r[1].(int64)), r[0].(string))
+			mssqlConfigDesc, prometheus.GaugeValue, r.ValueInUse, r.Name)
 	}
 
 	return nil
@@ -96,6 +96,9 @@ var (
 		"Reduced memory grants/sec":        true,
 		"Requests completed/sec":           true}
 
+	// perfCounterSubsystem is the subsystem of the counters, named after the counter at runtime
+	perfCounterSubsystem = builtinSubsystem("perfcounter")
+
 	// oracleStatDesc = prometheus.NewDesc(
 	// 	prometheus.BuildFQName(namespace, "stat", "stat"),
 	// 	"Oracle Stats",
@@ -122,11 +125,11 @@ func (ScrapeMSSQLPerfCounter) Help() string {
 }
 
 type PerfCounter struct {
-	ObjectName   string
-	CounterName  string
-	InstanceName string
-	CntrValue    int64
-	CntrType     int64
+	ObjectName   string `db:"object_name"`
+	CounterName  string `db:"counter_name"`
+	InstanceName string `db:"instance_name,nullable"`
+	CntrValue    int64  `db:"cntr_value"`
+	CntrType     int64  `db:"cntr_type"`
 }
 
 func (ScrapeMSSQLPerfCounter) Version() float64 {
@@ -181,7 +184,7 @@ func (ScrapeMSSQLPerfCounter) ScrapeMSSQLPerfCounter(ctx context.Context, dbcli
 		}
 
 		perfCounterDesc := prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "perfcounter", formatLabel(c.CounterName)),
+			prometheus.BuildFQName(namespace, perfCounterSubsystem, formatLabel(c.CounterName)),
 			"MSSQL Performance Counter",
 			[]string{"object_name", "counter_name", "instance_name"}, nil)
 
@@ -207,29 +210,18 @@ func getPerfCounters(ctx context.Context, dbcli *dbutil.MSSQLClient) ([]PerfCoun
 	sql := `select object_name, counter_name, instance_name, cntr_value, cntr_type 
 	from sys.dm_os_performance_counters`
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var result []PerfCounter
+	err := selectRows(ctx, dbcli, &result, sql)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Query Error")
 		return nil, err
 	}
 
-	var result []PerfCounter
-
-	for _, r := range rows {
-
-		objectName := strings.TrimSpace(r[0].(string))
-		counterName := strings.TrimSpace(r[1].(string))
-		instanceName := strings.TrimSpace(r[2].(string))
-		cntrValue := r[3].(int64)
-		cntrType := r[4].(int64)
-
-		counter := PerfCounter{ObjectName: objectName,
-			CounterName:  counterName,
-			InstanceName: instanceName,
-			CntrValue:    cntrValue,
-			CntrType:     cntrType,
-		}
-		result = append(result, counter)
+	for i := range result {
+		c := &result[i]
+		c.ObjectName = strings.TrimSpace(c.ObjectName)
+		c.CounterName = strings.TrimSpace(c.CounterName)
+		c.InstanceName = strings.TrimSpace(c.InstanceName)
 	}
 	return result, nil
 }
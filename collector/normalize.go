@@ -0,0 +1,222 @@
+package collector
+
+import (
+	"strings"
+	"unicode"
+)
+
+// NormalizeSQL returns the T-SQL text with comments removed, string, numeric and binary
+// literals replaced by ?, IN lists and multi row VALUES collapsed, keywords and identifiers
+// lower cased and white space collapsed, so statements which only differ in literals
+// normalize to the same text. Quoted identifiers and variables are kept as they are.
+//
+//	SELECT * FROM t WHERE id IN (1, 2, 3) AND name = N'x' -- comment
+//
+// is normalized to
+//
+//	select * from t where id in (?) and name = ?
+func NormalizeSQL(text string) string {
+	tokens := collapseLists(tokenizeSQL(text))
+
+	var b strings.Builder
+	for i, tok := range tokens {
+		if i > 0 && !noSpaceBefore(tok) && !noSpaceAfter(tokens[i-1]) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(tok)
+	}
+	return b.String()
+}
+
+// Fingerprint returns a short stable hash of the normalized text.
+func Fingerprint(text string) string {
+	return getMd5(NormalizeSQL(text))[:16]
+}
+
+func noSpaceBefore(tok string) bool {
+	return tok == "," || tok == ")" || tok == "." || tok == ";"
+}
+
+func noSpaceAfter(tok string) bool {
+	return tok == "(" || tok == "."
+}
+
+// tokenizeSQL splits text into tokens, dropping white space and comments and replacing literals by ?.
+func tokenizeSQL(text string) []string {
+	r := []rune(text)
+	var tokens []string
+
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			// block comments nest in T-SQL
+			depth := 0
+			for i < len(r) {
+				if r[i] == '/' && i+1 < len(r) && r[i+1] == '*' {
+					depth++
+					i += 2
+				} else if r[i] == '*' && i+1 < len(r) && r[i+1] == '/' {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+
+		case c == '\'' || ((c == 'N' || c == 'n') && i+1 < len(r) && r[i+1] == '\''):
+			if c != '\'' {
+				i++
+			}
+			i = skipQuoted(r, i, '\'')
+			tokens = append(tokens, "?")
+
+		case c == '[':
+			start := i
+			i = skipQuoted(r, i, ']')
+			tokens = append(tokens, string(r[start:i]))
+
+		case c == '"':
+			start := i
+			i = skipQuoted(r, i, '"')
+			tokens = append(tokens, string(r[start:i]))
+
+		case c == '0' && i+1 < len(r) && (r[i+1] == 'x' || r[i+1] == 'X'):
+			i += 2
+			for i < len(r) && isHexDigit(r[i]) {
+				i++
+			}
+			tokens = append(tokens, "?")
+
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(r) && unicode.IsDigit(r[i+1])):
+			i = skipNumber(r, i)
+			tokens = append(tokens, "?")
+
+		case c == '@' || c == '#' || c == '_' || c == '$' || unicode.IsLetter(c):
+			start := i
+			for i < len(r) && isWordRune(r[i]) {
+				i++
+			}
+			word := string(r[start:i])
+			if c != '@' {
+				word = strings.ToLower(word)
+			}
+			tokens = append(tokens, word)
+
+		default:
+			start := i
+			i++
+			// two character operators
+			if i < len(r) && strings.ContainsRune("<>=!", c) && strings.ContainsRune("<>=", r[i]) {
+				i++
+			}
+			tokens = append(tokens, string(r[start:i]))
+		}
+	}
+	return tokens
+}
+
+// skipQuoted returns the position after the quoted text starting at i,
+// a doubled closing quote is an escaped quote.
+func skipQuoted(r []rune, i int, closing rune) int {
+	for i++; i < len(r); i++ {
+		if r[i] == closing {
+			if i+1 < len(r) && r[i+1] == closing {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+func skipNumber(r []rune, i int) int {
+	for i < len(r) && (unicode.IsDigit(r[i]) || r[i] == '.') {
+		i++
+	}
+	// the exponent digits are optional, 1e is the float 1
+	if i < len(r) && (r[i] == 'e' || r[i] == 'E') {
+		i++
+		if i+1 < len(r) && (r[i] == '+' || r[i] == '-') && unicode.IsDigit(r[i+1]) {
+			i++
+		}
+		for i < len(r) && unicode.IsDigit(r[i]) {
+			i++
+		}
+	}
+	return i
+}
+
+func isWordRune(c rune) bool {
+	return c == '@' || c == '#' || c == '_' || c == '$' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func isHexDigit(c rune) bool {
+	return unicode.IsDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// collapseLists replaces IN lists of literals by a single ? and keeps only the first
+// row of multi row VALUES.
+func collapseLists(tokens []string) []string {
+	var result []string
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		result = append(result, tok)
+
+		switch tok {
+		case "in":
+			if end, ok := placeholderList(tokens, i+1); ok {
+				result = append(result, "(", "?", ")")
+				i = end
+			}
+		case "values":
+			end, ok := placeholderList(tokens, i+1)
+			if !ok {
+				continue
+			}
+			result = append(result, tokens[i+1:end+1]...)
+			i = end
+			for i+1 < len(tokens) && tokens[i+1] == "," {
+				next, ok := placeholderList(tokens, i+2)
+				if !ok {
+					break
+				}
+				i = next
+			}
+		}
+	}
+	return result
+}
+
+// placeholderList reports whether tokens at i are a parenthesized list of ?,
+// and returns the position of the closing parenthesis.
+func placeholderList(tokens []string, i int) (int, bool) {
+	if i >= len(tokens) || tokens[i] != "(" {
+		return 0, false
+	}
+	for j := i + 1; j < len(tokens); j += 2 {
+		if tokens[j] != "?" || j+1 >= len(tokens) {
+			return 0, false
+		}
+		switch tokens[j+1] {
+		case ")":
+			return j + 1, true
+		case ",":
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
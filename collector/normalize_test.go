@@ -0,0 +1,132 @@
+package collector
+
+import "testing"
+
+func TestNormalizeSQL(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"doc example",
+			"SELECT * FROM t WHERE id IN (1, 2, 3) AND name = N'x' -- comment",
+			"select * from t where id in (?) and name = ?"},
+		{"white space",
+			"select\ta,\r\n  b\nfrom   t",
+			"select a, b from t"},
+		{"line comment at end",
+			"select 1 -- trailing",
+			"select ?"},
+		{"block comment",
+			"select /* one */ a from t",
+			"select a from t"},
+		{"nested block comment",
+			"select /* outer /* inner */ still comment */ a from t",
+			"select a from t"},
+		{"unterminated block comment",
+			"select a /* open",
+			"select a"},
+		{"doubled quote",
+			"select * from t where name = 'O''Brien' and x = 1",
+			"select * from t where name = ? and x = ?"},
+		{"unicode literal",
+			"select * from t where name = N'中文' or name = n'abc'",
+			"select * from t where name = ? or name = ?"},
+		{"empty literals",
+			"select '', N''",
+			"select ?, ?"},
+		{"unterminated literal",
+			"select 'abc",
+			"select ?"},
+		{"hex literal",
+			"select * from t where h = 0x1F2e and b = 0X",
+			"select * from t where h = ? and b = ?"},
+		{"numbers",
+			"select 1, 2.5, .5, 1e10, 1.5E-3, 2e+4",
+			"select ?, ?, ?, ?, ?, ?"},
+		{"negative number",
+			"select * from t where a = -1",
+			"select * from t where a = - ?"},
+		{"exponent without digits",
+			"select 1e, 2E-, 3ex from t",
+			"select ?, ? -, ? x from t"},
+		{"quoted identifiers are kept",
+			`select [Order Id], "Name" from [dbo].[Orders]`,
+			`select [Order Id], "Name" from [dbo].[Orders]`},
+		{"bracket with doubled bracket",
+			"select [a]]b] from t",
+			"select [a]]b] from t"},
+		{"variables keep their case",
+			"SELECT @Id, @@ROWCOUNT FROM #Temp WHERE x = @Name",
+			"select @Id, @@ROWCOUNT from #temp where x = @Name"},
+		{"operators",
+			"select * from t where a<>1 and b>=2 and c!=3 and d<=4",
+			"select * from t where a <> ? and b >= ? and c != ? and d <= ?"},
+		{"qualified names",
+			"SELECT t.a FROM dbo.t t",
+			"select t.a from dbo.t t"},
+		{"function call",
+			"select count(*), isnull(a, 0) from t;",
+			"select count (*), isnull (a, ?) from t;"},
+		{"in list of one",
+			"select * from t where id in (42)",
+			"select * from t where id in (?)"},
+		{"in list of different length",
+			"select * from t where id IN (1,2,3,4,5,6,7)",
+			"select * from t where id in (?)"},
+		{"in list with variables is kept",
+			"select * from t where id in (@a, @b)",
+			"select * from t where id in (@a, @b)"},
+		{"in subquery is kept",
+			"select * from t where id in (select id from u where v = 1)",
+			"select * from t where id in (select id from u where v = ?)"},
+		{"not in",
+			"select * from t where id not in ('a', 'b')",
+			"select * from t where id not in (?)"},
+		{"multi row values",
+			"insert into t (a, b) values (1, 'x'), (2, 'y'), (3, 'z')",
+			"insert into t (a, b) values (?, ?)"},
+		{"single row values",
+			"INSERT INTO t VALUES (1, 2)",
+			"insert into t values (?, ?)"},
+		{"values with variables is kept",
+			"insert into t values (@a, 1), (@b, 2)",
+			"insert into t values (@a, ?), (@b, ?)"},
+		{"values rows followed by statement",
+			"insert into t values (1), (2); select 1",
+			"insert into t values (?); select ?"},
+		{"empty", "", ""},
+		{"only comment", "-- nothing", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeSQL(tt.text)
+			if got != tt.want {
+				t.Errorf("NormalizeSQL(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	same := []string{
+		"SELECT * FROM t WHERE id IN (1, 2, 3) AND name = N'x'",
+		"select * from t where id in (4) and name = 'y' -- other",
+		"select  *  from t /* c */ where ID in (5,6) and NAME = N'z'",
+	}
+	for _, text := range same[1:] {
+		if Fingerprint(text) != Fingerprint(same[0]) {
+			t.Errorf("Fingerprint(%q) = %s, want %s of %q", text, Fingerprint(text), Fingerprint(same[0]), same[0])
+		}
+	}
+
+	if Fingerprint("select a from t") == Fingerprint("select b from t") {
+		t.Error("statements with different columns have the same fingerprint")
+	}
+
+	// fingerprints are label values of mssql_sql_stat, changing them starts new series
+	if got, want := Fingerprint(same[0]), "18cf68d6cb2866ca"; got != want {
+		t.Errorf("Fingerprint(%q) = %s, want %s", same[0], got, want)
+	}
+}
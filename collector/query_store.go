@@ -0,0 +1,419 @@
+package collector
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	// queryStoreOther is the query_id label of the executions of queries outside the top queries
+	queryStoreOther = "other"
+	// queryStoreRetention is how long runtime stats rows and queries without executions are tracked
+	queryStoreRetention = 2 * time.Hour
+)
+
+var (
+	queryStoreLimit = kingpin.Flag(
+		"collect.mssql_query_store.limit",
+		"Number of top queries by CPU per database exported by mssql_query_store, the others are summed up with query_id \"other\".",
+	).Default("10").Int()
+
+	queryStoreLabels = []string{"database", "query_id"}
+
+	queryStoreExecutionsDesc = newDesc("query_store", "executions_total",
+		"Number of executions of the query recorded by Query Store.",
+		queryStoreLabels)
+
+	queryStoreDurationDesc = newDesc("query_store", "duration_seconds_total",
+		"Duration of the executions of the query recorded by Query Store.",
+		queryStoreLabels)
+
+	queryStoreCPUDesc = newDesc("query_store", "cpu_seconds_total",
+		"CPU time of the executions of the query recorded by Query Store.",
+		queryStoreLabels)
+
+	queryStoreLogicalReadsDesc = newDesc("query_store", "logical_reads_total",
+		"Logical reads in pages of the executions of the query recorded by Query Store.",
+		queryStoreLabels)
+
+	queryStoreQueryPlansDesc = newDesc("query_store", "query_plans",
+		"Number of plans of the top query in Query Store.",
+		queryStoreLabels)
+
+	queryStoreMultiPlanQueriesDesc = newDesc("query_store", "multi_plan_queries",
+		"Number of queries with more than one plan in Query Store.",
+		[]string{"database"})
+
+	queryStoreForcedPlansDesc = newDesc("query_store", "forced_plans",
+		"Number of forced plans in Query Store.",
+		[]string{"database"})
+
+	queryStoreForceFailuresDesc = newDesc("query_store", "forced_plan_failures_total",
+		"Number of times forcing the plan failed, only reported for forced plans which failed.",
+		[]string{"database", "query_id", "plan_id"})
+
+	queryStoreActualStateDesc = newDesc("query_store", "actual_state",
+		"Actual operation mode of Query Store, 1 for the current mode.",
+		[]string{"database", "state"})
+
+	queryStoreDesiredStateDesc = newDesc("query_store", "desired_state",
+		"Desired operation mode of Query Store, 1 for the configured mode.",
+		[]string{"database", "state"})
+
+	queryStoreReadonlyReasonDesc = newDesc("query_store", "readonly_reason",
+		"Reason Query Store is read only, 0 when it is not, 65536 when the maximum storage size is reached.",
+		[]string{"database"})
+
+	queryStoreStorageUsedDesc = newDesc("query_store", "storage_used_bytes",
+		"Storage used by Query Store.",
+		[]string{"database"})
+
+	queryStoreStorageMaxDesc = newDesc("query_store", "storage_max_bytes",
+		"Maximum storage size of Query Store.",
+		[]string{"database"})
+
+	queryStoreActualStates  = []string{"OFF", "READ_ONLY", "READ_WRITE", "ERROR"}
+	queryStoreDesiredStates = []string{"OFF", "READ_ONLY", "READ_WRITE"}
+
+	intervalQueryStore = time.Minute
+)
+
+type queryStoreOptionsRow struct {
+	ActualState    string    `db:"actual_state_desc,nullable"`
+	DesiredState   string    `db:"desired_state_desc,nullable"`
+	ReadonlyReason float64   `db:"readonly_reason,nullable"`
+	StorageUsed    float64   `db:"storage_used,nullable"`
+	StorageMax     float64   `db:"storage_max,nullable"`
+	ServerTime     time.Time `db:"server_time"`
+}
+
+// queryStoreRuntimeRow is a row of sys.query_store_runtime_stats, the stats of a plan in a
+// runtime stats interval; the row of the current interval grows with every execution.
+type queryStoreRuntimeRow struct {
+	RuntimeStatsID     int64     `db:"runtime_stats_id"`
+	QueryID            int64     `db:"query_id"`
+	FirstExecutionTime time.Time `db:"first_execution_time"`
+	LastExecutionTime  time.Time `db:"last_execution_time"`
+	Executions         float64   `db:"executions"`
+	Duration           float64   `db:"duration"`
+	CPUTime            float64   `db:"cpu_time"`
+	LogicalReads       float64   `db:"logical_reads"`
+}
+
+type queryStorePlanRow struct {
+	QueryID int64   `db:"query_id"`
+	Plans   float64 `db:"plans"`
+}
+
+type queryStoreForcedRow struct {
+	QueryID       int64   `db:"query_id"`
+	PlanID        int64   `db:"plan_id"`
+	ForceFailures float64 `db:"force_failure_count"`
+}
+
+type queryStoreSummaryRow struct {
+	MultiPlanQueries float64 `db:"multi_plan_queries"`
+	ForcedPlans      float64 `db:"forced_plans"`
+}
+
+// queryStoreCounters accumulates executions of queries, durations in microseconds.
+type queryStoreCounters struct {
+	Executions   float64
+	Duration     float64
+	CPUTime      float64
+	LogicalReads float64
+}
+
+// queryStoreTotal is the executions of a query since the exporter started, queries are ranked
+// by it. Exported only holds the executions while the query was in the top queries, the others
+// are part of other.
+type queryStoreTotal struct {
+	queryStoreCounters
+	LastSeen time.Time
+	Exported queryStoreCounters
+}
+
+// addDiff adds the executions of a runtime stats row since prev.
+func (t *queryStoreCounters) addDiff(current, prev queryStoreRuntimeRow) {
+	t.Executions += nonNegativeFloat(current.Executions - prev.Executions)
+	t.Duration += nonNegativeFloat(current.Duration - prev.Duration)
+	t.CPUTime += nonNegativeFloat(current.CPUTime - prev.CPUTime)
+	t.LogicalReads += nonNegativeFloat(current.LogicalReads - prev.LogicalReads)
+}
+
+func (t *queryStoreCounters) addTotal(o *queryStoreCounters) {
+	t.Executions += o.Executions
+	t.Duration += o.Duration
+	t.CPUTime += o.CPUTime
+	t.LogicalReads += o.LogicalReads
+}
+
+// queryStoreDatabase is the state of the Query Store of a database between scrapes.
+type queryStoreDatabase struct {
+	// lastServer is the server time of the last read, rows first executed after it are all new
+	lastServer time.Time
+	// runtime are the last read rows by runtime_stats_id
+	runtime map[int64]queryStoreRuntimeRow
+	totals  map[int64]*queryStoreTotal
+	other   queryStoreCounters
+}
+
+// ScrapeQueryStore exports the executions of the top queries of the Query Store of every database,
+// plan counts, forced plan failures and the state of Query Store. Executions are the growth of the
+// runtime stats rows since the last scrape, so only rows executed since then are read.
+type ScrapeQueryStore struct {
+	mu        sync.Mutex
+	databases map[string]*queryStoreDatabase
+}
+
+func (*ScrapeQueryStore) Name() string {
+	return "mssql_query_store"
+}
+
+func (*ScrapeQueryStore) Help() string {
+	return "collect top queries, plans and state of Query Store of every user database"
+}
+
+func (*ScrapeQueryStore) Version() float64 {
+	return 13.0
+}
+
+func (s *ScrapeQueryStore) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.databases == nil {
+		s.databases = make(map[string]*queryStoreDatabase)
+	}
+	scraped := make(map[string]bool)
+	err := forEachDatabase(ctx, dbcli, s.Name(), func(db string) error {
+		scraped[db] = true
+		return s.scrapeDatabase(ctx, dbcli, ch, db)
+	})
+
+	// state of databases no longer monitored is dropped
+	for db := range s.databases {
+		if !scraped[db] {
+			delete(s.databases, db)
+		}
+	}
+	return err
+}
+
+func (s *ScrapeQueryStore) scrapeDatabase(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, db string) error {
+	sql := `SELECT actual_state_desc, desired_state_desc, readonly_reason,
+  current_storage_size_mb * 1048576 AS storage_used, max_storage_size_mb * 1048576 AS storage_max,
+  SYSDATETIMEOFFSET() AS server_time
+FROM sys.database_query_store_options
+`
+	var options []queryStoreOptionsRow
+	err := selectRows(ctx, dbcli, &options, dbutil.InDatabase(db, sql))
+	if err != nil {
+		return err
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	o := options[0]
+
+	sendStateSet(ch, queryStoreActualStateDesc, queryStoreActualStates, o.ActualState, db)
+	sendStateSet(ch, queryStoreDesiredStateDesc, queryStoreDesiredStates, o.DesiredState, db)
+	if o.ActualState == "OFF" {
+		delete(s.databases, db)
+		return nil
+	}
+	ch <- prometheus.MustNewConstMetric(queryStoreReadonlyReasonDesc, prometheus.GaugeValue, o.ReadonlyReason, db)
+	ch <- prometheus.MustNewConstMetric(queryStoreStorageUsedDesc, prometheus.GaugeValue, o.StorageUsed, db)
+	ch <- prometheus.MustNewConstMetric(queryStoreStorageMaxDesc, prometheus.GaugeValue, o.StorageMax, db)
+
+	err = s.scrapeRuntime(ctx, dbcli, ch, db, o.ServerTime)
+	if err != nil {
+		return err
+	}
+	return s.scrapePlans(ctx, dbcli, ch, db)
+}
+
+func (s *ScrapeQueryStore) scrapeRuntime(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, db string, serverTime time.Time) error {
+	state, ok := s.databases[db]
+	since := serverTime.Add(-time.Minute)
+	if ok {
+		// the minute before the last read is read again, rows executed while it ran are not missed
+		since = state.lastServer.Add(-time.Minute)
+	}
+
+	// durations and CPU times are in microseconds
+	sql := `SELECT rs.runtime_stats_id, p.query_id, rs.first_execution_time, rs.last_execution_time,
+  rs.count_executions AS executions,
+  rs.avg_duration * rs.count_executions AS duration,
+  rs.avg_cpu_time * rs.count_executions AS cpu_time,
+  rs.avg_logical_io_reads * rs.count_executions AS logical_reads
+FROM sys.query_store_runtime_stats rs
+JOIN sys.query_store_plan p ON p.plan_id = rs.plan_id
+WHERE rs.last_execution_time > @p1
+`
+	var rows []queryStoreRuntimeRow
+	err := selectRows(ctx, dbcli, &rows, dbutil.InDatabase(db, sql), since)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		// the first read is only a baseline
+		state = &queryStoreDatabase{runtime: make(map[int64]queryStoreRuntimeRow), totals: make(map[int64]*queryStoreTotal)}
+		s.databases[db] = state
+		state.update(rows, serverTime)
+		return nil
+	}
+
+	top := state.add(rows, serverTime, *queryStoreLimit)
+
+	for id := range top {
+		sendQueryStoreTotal(ch, &state.totals[id].Exported, db, formatInt64(id))
+	}
+	sendQueryStoreTotal(ch, &state.other, db, queryStoreOther)
+
+	if len(top) == 0 {
+		return nil
+	}
+	var ids []string
+	for id := range top {
+		ids = append(ids, formatInt64(id))
+	}
+	planSQL := `SELECT query_id, COUNT(*) AS plans FROM sys.query_store_plan
+WHERE query_id IN (` + strings.Join(ids, ",") + `)
+GROUP BY query_id
+`
+	var plans []queryStorePlanRow
+	err = selectRows(ctx, dbcli, &plans, dbutil.InDatabase(db, planSQL))
+	if err != nil {
+		return err
+	}
+	for _, p := range plans {
+		ch <- prometheus.MustNewConstMetric(queryStoreQueryPlansDesc, prometheus.GaugeValue, p.Plans, db, formatInt64(p.QueryID))
+	}
+	return nil
+}
+
+func (s *ScrapeQueryStore) scrapePlans(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, db string) error {
+	sql := `SELECT
+  (SELECT COUNT(*) FROM (SELECT query_id FROM sys.query_store_plan GROUP BY query_id HAVING COUNT(*) > 1) q) AS multi_plan_queries,
+  (SELECT COUNT(*) FROM sys.query_store_plan WHERE is_forced_plan = 1) AS forced_plans
+`
+	var summary []queryStoreSummaryRow
+	err := selectRows(ctx, dbcli, &summary, dbutil.InDatabase(db, sql))
+	if err != nil {
+		return err
+	}
+	for _, r := range summary {
+		ch <- prometheus.MustNewConstMetric(queryStoreMultiPlanQueriesDesc, prometheus.GaugeValue, r.MultiPlanQueries, db)
+		ch <- prometheus.MustNewConstMetric(queryStoreForcedPlansDesc, prometheus.GaugeValue, r.ForcedPlans, db)
+	}
+
+	forcedSQL := `SELECT query_id, plan_id, force_failure_count
+FROM sys.query_store_plan
+WHERE is_forced_plan = 1 AND force_failure_count > 0
+`
+	var forced []queryStoreForcedRow
+	err = selectRows(ctx, dbcli, &forced, dbutil.InDatabase(db, forcedSQL))
+	if err != nil {
+		return err
+	}
+	for _, r := range forced {
+		ch <- prometheus.MustNewConstMetric(queryStoreForceFailuresDesc, prometheus.CounterValue, r.ForceFailures,
+			db, formatInt64(r.QueryID), formatInt64(r.PlanID))
+	}
+	return nil
+}
+
+// add adds the executions of rows since the last read to the totals of their queries, the
+// exported counters of the limit top queries and other, and returns the ids of the top queries.
+func (d *queryStoreDatabase) add(rows []queryStoreRuntimeRow, serverTime time.Time, limit int) map[int64]bool {
+	deltas := make(map[int64]*queryStoreCounters)
+	for _, r := range rows {
+		prev, seen := d.runtime[r.RuntimeStatsID]
+		if !seen && r.FirstExecutionTime.Before(d.lastServer) {
+			// older row not in the baseline, its earlier executions are unknown
+			continue
+		}
+		if r.Executions < prev.Executions {
+			prev = queryStoreRuntimeRow{}
+		}
+		delta, ok := deltas[r.QueryID]
+		if !ok {
+			delta = &queryStoreCounters{}
+			deltas[r.QueryID] = delta
+		}
+		delta.addDiff(r, prev)
+	}
+
+	for id, delta := range deltas {
+		total, ok := d.totals[id]
+		if !ok {
+			total = &queryStoreTotal{}
+			d.totals[id] = total
+		}
+		total.addTotal(delta)
+		total.LastSeen = serverTime
+	}
+	top := d.topQueries(limit)
+	for id, delta := range deltas {
+		if top[id] {
+			d.totals[id].Exported.addTotal(delta)
+		} else {
+			d.other.addTotal(delta)
+		}
+	}
+
+	d.update(rows, serverTime)
+	return top
+}
+
+// update keeps the read rows as baseline of the next read and forgets rows and queries
+// not executed for queryStoreRetention.
+func (d *queryStoreDatabase) update(rows []queryStoreRuntimeRow, serverTime time.Time) {
+	for _, r := range rows {
+		d.runtime[r.RuntimeStatsID] = r
+	}
+	for id, r := range d.runtime {
+		if serverTime.Sub(r.LastExecutionTime) > queryStoreRetention {
+			delete(d.runtime, id)
+		}
+	}
+	for id, t := range d.totals {
+		if serverTime.Sub(t.LastSeen) > queryStoreRetention {
+			delete(d.totals, id)
+		}
+	}
+	d.lastServer = serverTime
+}
+
+// topQueries returns the ids of the limit queries with the most CPU time.
+func (d *queryStoreDatabase) topQueries(limit int) map[int64]bool {
+	ids := make([]int64, 0, len(d.totals))
+	for id := range d.totals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return d.totals[ids[i]].CPUTime > d.totals[ids[j]].CPUTime
+	})
+
+	result := make(map[int64]bool)
+	for i := 0; i < limit && i < len(ids); i++ {
+		result[ids[i]] = true
+	}
+	return result
+}
+
+func sendQueryStoreTotal(ch chan<- prometheus.Metric, t *queryStoreCounters, db, queryID string) {
+	ch <- prometheus.MustNewConstMetric(queryStoreExecutionsDesc, prometheus.CounterValue, t.Executions, db, queryID)
+	ch <- prometheus.MustNewConstMetric(queryStoreDurationDesc, prometheus.CounterValue, t.Duration/1e6, db, queryID)
+	ch <- prometheus.MustNewConstMetric(queryStoreCPUDesc, prometheus.CounterValue, t.CPUTime/1e6, db, queryID)
+	ch <- prometheus.MustNewConstMetric(queryStoreLogicalReadsDesc, prometheus.CounterValue, t.LogicalReads, db, queryID)
+}
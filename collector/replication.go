@@ -0,0 +1,193 @@
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	skipReasonNotDistributor = "not_distributor"
+)
+
+var (
+	replicationAgentLabels = []string{"type", "agent", "publisher", "publisher_db", "publication", "subscriber", "subscriber_db"}
+
+	replicationAgentStatusDesc = newDesc("replication", "agent_status",
+		"Status of the last history entry of the replication agent.",
+		append(replicationAgentLabels, "status"))
+
+	replicationAgentLastStatusDesc = newDesc("replication", "agent_last_status_timestamp_seconds",
+		"Time of the last history entry of the replication agent.",
+		replicationAgentLabels)
+
+	replicationAgentLastErrorDesc = newDesc("replication", "agent_last_error_timestamp_seconds",
+		"Time of the last history entry with an error of the replication agent, not reported without errors in the history.",
+		replicationAgentLabels)
+
+	replicationLatencyDesc = newDesc("replication", "latency_seconds",
+		"Current latency of the replication agent as shown by Replication Monitor.",
+		replicationAgentLabels)
+
+	replicationUndistributedDesc = newDesc("replication", "undistributed_commands",
+		"Number of commands in the distribution database not yet delivered to the subscription.",
+		replicationAgentLabels)
+
+	// runstatus of MSdistribution_history and MSlogreader_history, starting from 1
+	replicationAgentStatuses = []string{"started", "succeeded", "in_progress", "idle", "retrying", "failed"}
+
+	// MSdistribution_status aggregates MSrepl_commands, which is expensive on a busy distributor
+	intervalReplication = time.Minute
+)
+
+// replicationAgentRow is a log reader or distribution agent of a distribution database,
+// times are in seconds before the current time of the server since the history tables
+// keep them in server local time.
+type replicationAgentRow struct {
+	AgentType     string   `db:"agent_type"`
+	AgentName     string   `db:"agent_name"`
+	Publisher     string   `db:"publisher"`
+	PublisherDB   string   `db:"publisher_db"`
+	Publication   string   `db:"publication"`
+	Subscriber    string   `db:"subscriber"`
+	SubscriberDB  string   `db:"subscriber_db"`
+	ServerEpoch   float64  `db:"server_epoch"`
+	RunStatus     *int64   `db:"runstatus"`
+	LastStatusAge *float64 `db:"last_status_age_seconds"`
+	LastErrorAge  *float64 `db:"last_error_age_seconds"`
+	Latency       *float64 `db:"latency_seconds"`
+	Undistributed *float64 `db:"undistributed_commands"`
+}
+
+// ScrapeReplication collects the state of the transactional replication agents when the
+// instance is a distributor. It is disabled by default since counting the undistributed
+// commands reads the commands in the distribution database.
+type ScrapeReplication struct{}
+
+func (ScrapeReplication) Name() string {
+	return "mssql_replication"
+}
+
+func (ScrapeReplication) Help() string {
+	return "collect transactional replication agent status, latency and undistributed commands from the distribution databases"
+}
+
+func (ScrapeReplication) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeReplication) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	sql := `SELECT name FROM sys.databases WHERE is_distributor = 1 AND state = 0 ORDER BY name`
+	var databases []databaseNameRow
+	err := selectRows(ctx, dbcli, &databases, sql)
+	if err != nil {
+		return err
+	}
+	if len(databases) == 0 {
+		return &SkipError{Reason: skipReasonNotDistributor}
+	}
+
+	names := make([]string, len(databases))
+	for i, db := range databases {
+		names[i] = db.Name
+	}
+	return forEachOf(ctx, names, s.Name(), func(db string) error {
+		return s.scrapeDistributionDB(ctx, dbcli, ch, db)
+	})
+}
+
+func (s *ScrapeReplication) scrapeDistributionDB(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, db string) error {
+	// publisher_id and subscriber_id refer to MSreplservers where it exists (2016 SP2 and
+	// later), to sys.servers of the distributor before; negative subscriber ids are virtual
+	// subscriptions. MSreplication_monitordata is refreshed by the Replication monitoring
+	// refresher job and has a row per publication for a log reader agent.
+	sql := `SET NOCOUNT ON;
+DECLARE @servers TABLE (srvid int PRIMARY KEY, srvname sysname);
+IF OBJECT_ID(N'dbo.MSreplservers') IS NOT NULL
+  INSERT INTO @servers SELECT srvid, srvname FROM dbo.MSreplservers;
+ELSE
+  INSERT INTO @servers SELECT server_id, name FROM sys.servers;
+
+SELECT N'distribution' AS agent_type, a.name AS agent_name,
+  ISNULL(p.srvname, N'') AS publisher, a.publisher_db, a.publication,
+  ISNULL(sub.srvname, N'') AS subscriber, ISNULL(a.subscriber_db, N'') AS subscriber_db,
+  DATEDIFF(second, '19700101', GETUTCDATE()) AS server_epoch,
+  h.runstatus, DATEDIFF(second, h.[time], GETDATE()) AS last_status_age_seconds,
+  DATEDIFF(second, e.[time], GETDATE()) AS last_error_age_seconds,
+  m.latency_seconds, ISNULL(u.undistributed_commands, 0) AS undistributed_commands
+FROM dbo.MSdistribution_agents a
+LEFT JOIN @servers p ON p.srvid = a.publisher_id
+LEFT JOIN @servers sub ON sub.srvid = a.subscriber_id
+OUTER APPLY (
+  SELECT TOP (1) runstatus, [time] FROM dbo.MSdistribution_history
+  WHERE agent_id = a.id ORDER BY [timestamp] DESC
+) h
+OUTER APPLY (
+  SELECT MAX([time]) AS [time] FROM dbo.MSdistribution_history
+  WHERE agent_id = a.id AND error_id <> 0
+) e
+OUTER APPLY (
+  SELECT MAX(cur_latency) AS latency_seconds FROM dbo.MSreplication_monitordata
+  WHERE agent_id = a.id AND agent_type = 3
+) m
+LEFT JOIN (
+  SELECT agent_id, SUM(CAST(UndelivCmdsInDistDB AS bigint)) AS undistributed_commands
+  FROM dbo.MSdistribution_status
+  GROUP BY agent_id
+) u ON u.agent_id = a.id
+WHERE a.subscriber_id >= 0
+UNION ALL
+SELECT N'log_reader', a.name,
+  ISNULL(p.srvname, N''), a.publisher_db, N'', N'', N'',
+  DATEDIFF(second, '19700101', GETUTCDATE()),
+  h.runstatus, DATEDIFF(second, h.[time], GETDATE()),
+  DATEDIFF(second, e.[time], GETDATE()),
+  m.latency_seconds, NULL
+FROM dbo.MSlogreader_agents a
+LEFT JOIN @servers p ON p.srvid = a.publisher_id
+OUTER APPLY (
+  SELECT TOP (1) runstatus, [time] FROM dbo.MSlogreader_history
+  WHERE agent_id = a.id ORDER BY [timestamp] DESC
+) h
+OUTER APPLY (
+  SELECT MAX([time]) AS [time] FROM dbo.MSlogreader_history
+  WHERE agent_id = a.id AND error_id <> 0
+) e
+OUTER APPLY (
+  SELECT MAX(cur_latency) AS latency_seconds FROM dbo.MSreplication_monitordata
+  WHERE agent_id = a.id AND agent_type = 2
+) m
+`
+	var rows []replicationAgentRow
+	err := selectRows(ctx, dbcli, &rows, dbutil.InDatabase(db, sql))
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		labels := []string{r.AgentType, r.AgentName, r.Publisher, r.PublisherDB, r.Publication, r.Subscriber, r.SubscriberDB}
+
+		if r.RunStatus != nil {
+			status := formatInt64(*r.RunStatus)
+			if *r.RunStatus >= 1 && int(*r.RunStatus) <= len(replicationAgentStatuses) {
+				status = replicationAgentStatuses[*r.RunStatus-1]
+			}
+			sendStateSet(ch, replicationAgentStatusDesc, replicationAgentStatuses, status, labels...)
+		}
+		if r.LastStatusAge != nil {
+			ch <- prometheus.MustNewConstMetric(replicationAgentLastStatusDesc, prometheus.GaugeValue, r.ServerEpoch-*r.LastStatusAge, labels...)
+		}
+		if r.LastErrorAge != nil {
+			ch <- prometheus.MustNewConstMetric(replicationAgentLastErrorDesc, prometheus.GaugeValue, r.ServerEpoch-*r.LastErrorAge, labels...)
+		}
+		if r.Latency != nil {
+			ch <- prometheus.MustNewConstMetric(replicationLatencyDesc, prometheus.GaugeValue, *r.Latency, labels...)
+		}
+		if r.Undistributed != nil {
+			ch <- prometheus.MustNewConstMetric(replicationUndistributedDesc, prometheus.GaugeValue, *r.Undistributed, labels...)
+		}
+	}
+	return nil
+}
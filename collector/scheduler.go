@@ -0,0 +1,366 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	// DefaultInterval is the interval of scrapers without a default or configured interval.
+	DefaultInterval = 15 * time.Second
+)
+
+var (
+	collectorDataAgeDesc = newDesc(exporter, "collector_data_age_seconds",
+		"Seconds since the metrics of the collector were last scraped successfully.",
+		[]string{"collector"})
+
+	collectorSkippedDesc = newDesc(exporter, "collector_skipped",
+		"Whether the collector is skipped for the instance, with the reason.",
+		[]string{"collector", "reason"})
+
+	// defaultIntervals of scrapers too expensive to run on DefaultInterval
+	defaultIntervals = map[string]time.Duration{
+		ScrapeDbSpace{}.Name():            intervalDbSpace,
+		ScrapeDbLog{}.Name():              intervalDbLog,
+		ScrapeDbBackup{}.Name():           intervalDbBackup,
+		ScrapeAgentJob{}.Name():           intervalAgentJob,
+		ScrapeWaitStat{}.Name():           intervalWaitStat,
+		ScrapeDbMirrorState{}.Name():      intervalDbMirrorState,
+		(&ScrapeSQLStat{}).Name():         intervalSQLStat,
+		ScrapeIndex{}.Name():              intervalIndex,
+		ScrapeIndexFragmentation{}.Name(): intervalIndexFragmentation,
+		(&ScrapeQueryStore{}).Name():      intervalQueryStore,
+		ScrapeReplication{}.Name():        intervalReplication,
+		(&ScrapeDeadlock{}).Name():        intervalDeadlock,
+	}
+)
+
+// Settings overrides the interval and timeout of a collector, zero values keep the defaults.
+// The timeout defaults to the interval.
+type Settings struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Enabled overrides the --collect flag of the collector for targets without a collectors list.
+	Enabled *bool `yaml:"enabled"`
+}
+
+// scrapeResult is the last successful run of a scraper.
+type scrapeResult struct {
+	metrics    []prometheus.Metric
+	time       time.Time
+	skipReason string
+}
+
+// CollectorStatus is the outcome of the last run of a collector.
+type CollectorStatus struct {
+	Name          string
+	LastRun       time.Time
+	Duration      time.Duration
+	Success       bool
+	SkipReason    string
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// scheduler runs every scraper of a target on its own interval in the background
+// and keeps the most recent result of each one.
+type scheduler struct {
+	target   *Target
+	settings map[string]Settings
+
+	mu      sync.RWMutex
+	results map[string]*scrapeResult
+	status  map[string]CollectorStatus
+	ready   map[string]chan struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newScheduler(t *Target, settings map[string]Settings) *scheduler {
+	return &scheduler{
+		target:   t,
+		settings: settings,
+		results:  make(map[string]*scrapeResult),
+		status:   make(map[string]CollectorStatus),
+		ready:    make(map[string]chan struct{}),
+	}
+}
+
+// prepare creates the ready channels of scrapers without an inherited result, it is called
+// before the scheduler is published to the target since ready is read without a lock.
+func (s *scheduler) prepare(scrapers []Scraper) {
+	for _, scraper := range scrapers {
+		if _, ok := s.ready[scraper.Name()]; !ok {
+			s.ready[scraper.Name()] = make(chan struct{})
+		}
+	}
+}
+
+func (s *scheduler) start(scrapers []Scraper) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	for _, scraper := range scrapers {
+		s.wg.Add(1)
+		go func(scraper Scraper) {
+			defer s.wg.Done()
+			s.run(ctx, scraper)
+		}(scraper)
+	}
+}
+
+func (s *scheduler) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// inherit copies the last results and status of scrapers from the scheduler old,
+// so a reload neither loses them nor runs the scrapers before their next interval.
+func (s *scheduler) inherit(old *scheduler, scrapers []Scraper) {
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+
+	for _, scraper := range scrapers {
+		name := scraper.Name()
+		status, ok := old.status[name]
+		if !ok {
+			continue
+		}
+		s.status[name] = status
+		if result, ok := old.results[name]; ok {
+			s.results[name] = result
+		}
+		ready := make(chan struct{})
+		close(ready)
+		s.ready[name] = ready
+	}
+}
+
+func (s *scheduler) intervalOf(name string) (time.Duration, time.Duration) {
+	interval, ok := defaultIntervals[name]
+	if !ok {
+		interval = DefaultInterval
+	}
+
+	settings := s.settings[name]
+	if settings.Interval > 0 {
+		interval = settings.Interval
+	}
+
+	timeout := interval
+	if settings.Timeout > 0 {
+		timeout = settings.Timeout
+	}
+	return interval, timeout
+}
+
+func (s *scheduler) run(ctx context.Context, scraper Scraper) {
+	interval, timeout := s.intervalOf(scraper.Name())
+	log.WithFields(log.Fields{"target": s.target.Name, "scraper": scraper.Name(),
+		"interval": interval, "timeout": timeout}).Debug("Scheduler Started")
+
+	// ready is also closed when the scheduler is stopped before the first run completed,
+	// so a collect holding this scheduler does not wait for its timeout
+	ready := s.ready[scraper.Name()]
+	defer func() {
+		if ready != nil {
+			close(ready)
+		}
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// a scraper inherited from before a reload continues on its schedule
+	s.mu.RLock()
+	lastRun := s.status[scraper.Name()].LastRun
+	s.mu.RUnlock()
+	if wait := interval - time.Since(lastRun); !lastRun.IsZero() && wait > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		ticker.Reset(interval)
+	}
+
+	for {
+		s.scrapeOnce(ctx, scraper, timeout)
+		if ready != nil {
+			close(ready)
+			ready = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrapeOnce runs scraper and records its duration, success and error.
+// A run cancelled by stopping the scheduler is not recorded, it is neither a failure
+// nor a run the scheduler replacing this one on a reload should wait an interval after.
+func (s *scheduler) scrapeOnce(ctx context.Context, scraper Scraper, timeout time.Duration) {
+	name := scraper.Name()
+	start := time.Now()
+	result, err := s.scrape(ctx, scraper, timeout)
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		log.WithFields(log.Fields{"target": s.target.Name, "scraper": name, "error": err}).Debug("Scrape Cancelled")
+		return
+	}
+
+	s.target.metrics.CollectorDuration.WithLabelValues(name).Set(duration.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status[name]
+	status.Name = name
+	status.LastRun = start
+	status.Duration = duration
+	status.Success = err == nil
+	if err != nil {
+		log.WithFields(log.Fields{"target": s.target.Name, "scraper": name, "error": err}).Error("Scrape has error")
+		s.target.metrics.ScrapeErrors.WithLabelValues(name).Inc()
+		s.target.metrics.CollectorSuccess.WithLabelValues(name).Set(0)
+		status.LastError = err.Error()
+		status.LastErrorTime = start
+	} else {
+		s.target.metrics.CollectorSuccess.WithLabelValues(name).Set(1)
+		s.results[name] = result
+		status.SkipReason = result.skipReason
+	}
+	s.status[name] = status
+}
+
+func (s *scheduler) scrape(ctx context.Context, scraper Scraper, timeout time.Duration) (*scrapeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ins, err := s.target.instanceInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get instance info: %w", err)
+	}
+
+	if !ins.ServerVersion.AtLeastRelease(scraper.Version()) {
+		log.WithFields(log.Fields{"target": s.target.Name, "scraper": scraper.Name(),
+			"version": ins.ServerVersion.String(), "required": scraper.Version()}).Debug("Scraper Skipped")
+		return &scrapeResult{time: time.Now(), skipReason: skipReasonVersion}, nil
+	}
+
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+
+	ctx = context.WithValue(ctx, skippedRowsKey{}, s.target.metrics.SkippedRows.WithLabelValues(scraper.Name()))
+	err = safeScrape(ctx, scraper, s.target.dbclient, ch, ins)
+	close(ch)
+	<-done
+
+	var skipErr *SkipError
+	if errors.As(err, &skipErr) {
+		return &scrapeResult{time: time.Now(), skipReason: skipErr.Reason}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &scrapeResult{metrics: metrics, time: time.Now()}, nil
+}
+
+// safeScrape runs scraper, turning a panic into an error so a malformed row can not crash the exporter.
+func safeScrape(ctx context.Context, scraper Scraper, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{"scraper": scraper.Name(), "panic": r, "stack": string(debug.Stack())}).Error("Scraper Panic")
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return scraper.Scrape(ctx, dbcli, ch, ins)
+}
+
+// lastRunFailed reports whether the last run of any of scrapers failed.
+func (s *scheduler) lastRunFailed(scrapers []Scraper) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, scraper := range scrapers {
+		status, ok := s.status[scraper.Name()]
+		if ok && !status.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the status of every collector of the target, sorted by name.
+func (t *Target) Status() []CollectorStatus {
+	s, scrapers := t.current()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []CollectorStatus
+	for _, scraper := range scrapers {
+		status, ok := s.status[scraper.Name()]
+		if !ok {
+			status = CollectorStatus{Name: scraper.Name()}
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// collect sends the most recent metrics of scrapers to ch, waiting until ctx is done
+// for scrapers which have not completed their first run yet.
+func (s *scheduler) collect(ctx context.Context, ch chan<- prometheus.Metric, scrapers []Scraper) {
+	for _, scraper := range scrapers {
+		if ready, ok := s.ready[scraper.Name()]; ok {
+			select {
+			case <-ready:
+			case <-ctx.Done():
+			}
+		}
+
+		s.mu.RLock()
+		result, ok := s.results[scraper.Name()]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if result.skipReason != "" {
+			ch <- prometheus.MustNewConstMetric(collectorSkippedDesc, prometheus.GaugeValue, 1,
+				scraper.Name(), result.skipReason)
+			continue
+		}
+
+		for _, m := range result.metrics {
+			ch <- m
+		}
+		ch <- prometheus.MustNewConstMetric(collectorDataAgeDesc, prometheus.GaugeValue,
+			time.Since(result.time).Seconds(), scraper.Name())
+	}
+}
@@ -15,9 +15,24 @@ type Scraper interface {
 	// Example: "Collect from SHOW ENGINE INNODB STATUS"
 	Help() string
 
-	// Version of MySQL from which scraper is available.
+	// Version of SQL Server from which scraper is available, as major.minor,
+	// e.g. 10.5 for 2008R2, 13.0 for 2016. See ServerVersion.AtLeastRelease.
 	Version() float64
 
 	// Scrape collects data from database connection and sends it over channel as prometheus metric.
 	Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ora *InstanceInfoAll) error
 }
+
+// SkipError is returned by Scrape when the scraper does not apply to the instance,
+// e.g. a collector for a feature which is not enabled.
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return "scraper skipped: " + e.Reason
+}
+
+const (
+	skipReasonVersion = "unsupported_version"
+)
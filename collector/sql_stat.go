@@ -2,172 +2,494 @@ package collector
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
 	"yunche.pro/dtsre/mssql_exporter/dbutil"
 )
 
+const (
+	// sqlStatOther is the fingerprint of the statements outside of the top statements
+	sqlStatOther = "other"
+	// sqlStatMaxRows is the number of plans read per scrape, with the highest order-by values
+	sqlStatMaxRows = 500
+	// sqlStatRetention is how long a statement no longer in the plan cache is tracked
+	sqlStatRetention = time.Hour
+	// sqlStatMaxTracked limits the number of tracked statements
+	sqlStatMaxTracked = 5000
+	// sqlStatMaxHashes limits the query and plan hashes kept per statement
+	sqlStatMaxHashes = 20
+)
+
 var (
-	sqlStatCols = []string{"query_hash", "creation_time", "begin_time", "end_time", "query_text", "db_name",
-		"logical_reads", "physical_reads", "elapsed_time", "worker_time", "clr_time", "rows", "executions",
+	sqlStatLimit = kingpin.Flag(
+		"collect.mssql_sql_stat.limit",
+		"Number of top statements exported by mssql_sql_stat, the others of the 500 plans read per scrape are summed up with fingerprint \"other\".",
+	).Default("20").Int()
+
+	sqlStatOrderBy = kingpin.Flag(
+		"collect.mssql_sql_stat.order-by",
+		"Dimension the top statements of mssql_sql_stat are chosen by: cpu, elapsed, logical_reads, physical_reads, executions or rows.",
+	).Default("cpu").Enum("cpu", "elapsed", "logical_reads", "physical_reads", "executions", "rows")
+
+	sqlStatLabels = []string{"fingerprint", "database"}
+
+	sqlStatExecutionsDesc = newDesc("sql_stat", "executions_total",
+		"Number of executions of the statement.",
+		sqlStatLabels)
+
+	sqlStatLogicalReadsDesc = newDesc("sql_stat", "logical_reads_total",
+		"Number of logical reads and writes of the statement.",
+		sqlStatLabels)
+
+	sqlStatPhysicalReadsDesc = newDesc("sql_stat", "physical_reads_total",
+		"Number of physical reads of the statement.",
+		sqlStatLabels)
+
+	sqlStatCPUDesc = newDesc("sql_stat", "cpu_seconds_total",
+		"CPU time consumed by executions of the statement.",
+		sqlStatLabels)
+
+	sqlStatElapsedDesc = newDesc("sql_stat", "elapsed_seconds_total",
+		"Elapsed time of executions of the statement.",
+		sqlStatLabels)
+
+	sqlStatCLRDesc = newDesc("sql_stat", "clr_seconds_total",
+		"CLR time consumed by executions of the statement.",
+		sqlStatLabels)
+
+	sqlStatRowsDesc = newDesc("sql_stat", "rows_total",
+		"Number of rows returned by the statement.",
+		sqlStatLabels)
+
+	sqlStatQueryHashDesc = newDesc("sql_stat", "query_hash_info",
+		"Query hashes of sys.dm_exec_query_stats with the fingerprint. Like the fingerprint the query hash ignores literals, a fingerprint has several query hashes when its statements differ in e.g. the length of IN lists.",
+		[]string{"fingerprint", "database", "query_hash"})
+
+	sqlStatTrackedDesc = newDesc("sql_stat", "tracked_statements",
+		"Number of statements tracked by the collector, including the ones summed up as other.",
+		nil)
+
+	// sqlStatOrder returns the value statements are ranked by for every order-by dimension
+	sqlStatOrder = map[string]func(*sqlStatTotal) float64{
+		"cpu":            func(t *sqlStatTotal) float64 { return t.WorkerTime },
+		"elapsed":        func(t *sqlStatTotal) float64 { return t.ElapsedTime },
+		"logical_reads":  func(t *sqlStatTotal) float64 { return t.LogicalReads },
+		"physical_reads": func(t *sqlStatTotal) float64 { return t.PhysicalReads },
+		"executions":     func(t *sqlStatTotal) float64 { return t.ExecutionCount },
+		"rows":           func(t *sqlStatTotal) float64 { return t.Rows },
 	}
 
-	sqlStatDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "sql", "stat"),
-		"MSSQL Instance Info",
-		sqlStatCols, nil)
+	// sqlStatOrderColumns are the columns of sys.dm_exec_query_stats of every order-by dimension
+	sqlStatOrderColumns = map[string]string{
+		"cpu":            "qs.total_worker_time",
+		"elapsed":        "qs.total_elapsed_time",
+		"logical_reads":  "qs.total_logical_reads + qs.total_logical_writes",
+		"physical_reads": "qs.total_physical_reads",
+		"executions":     "qs.execution_count",
+		"rows":           "qs.total_rows",
+	}
 
 	intervalSQLStat = 30 * time.Second
 )
 
 type SQLStat struct {
-	QueryHash      string
-	CreationTime   string
-	ExecutionCount int64
-	LogicalReads   int64
-	PhysicalReads  int64
-	ElapsedTime    int64
-	WorkerTime     int64
-	ClrTime        int64
-	Rows           int64
-	SQLText        string
-	DBName         string
+	QueryHash      string    `db:"query_hash"`
+	PlanHash       string    `db:"query_plan_hash"`
+	PlanHandle     string    `db:"plan_handle"`
+	StatementStart int64     `db:"statement_start_offset"`
+	StatementEnd   int64     `db:"statement_end_offset"`
+	CreationTime   time.Time `db:"creation_time"`
+	ServerTime     time.Time `db:"server_time"`
+	ExecutionCount int64     `db:"execution_count"`
+	LogicalReads   int64     `db:"total_logical_reads"`
+	PhysicalReads  int64     `db:"total_physical_reads"`
+	ElapsedTime    int64     `db:"total_elapsed_time"`
+	WorkerTime     int64     `db:"total_worker_time"`
+	ClrTime        int64     `db:"total_clr_time"`
+	Rows           int64     `db:"total_rows"`
+	SQLText        string    `db:"query_text,nullable"`
+	DBName         string    `db:"databasename"`
+	Fingerprint    string    `db:"-"`
+}
+
+// sqlStatCounters accumulates executions of statements, times are in microseconds.
+type sqlStatCounters struct {
+	ExecutionCount float64
+	LogicalReads   float64
+	PhysicalReads  float64
+	ElapsedTime    float64
+	WorkerTime     float64
+	ClrTime        float64
+	Rows           float64
+}
+
+// sqlStatTotal accumulates the executions of a statement since the exporter started,
+// the statements are ranked by these counters. Exported only holds the executions while
+// the statement was in the top statements, the others are part of other, so no execution
+// is exported twice when the statement enters the top.
+type sqlStatTotal struct {
+	sqlStatCounters
+	Fingerprint string
+	Database    string
+	Text        string
+	// QueryHashes and PlanHashes map the hashes of the statement to when they were last seen
+	QueryHashes map[string]time.Time
+	PlanHashes  map[string]time.Time
+	LastSeen    time.Time
+	Exported    sqlStatCounters
+}
+
+func (t *sqlStatCounters) add(s SQLStat) {
+	t.ExecutionCount += float64(s.ExecutionCount)
+	t.LogicalReads += float64(s.LogicalReads)
+	t.PhysicalReads += float64(s.PhysicalReads)
+	t.ElapsedTime += float64(s.ElapsedTime)
+	t.WorkerTime += float64(s.WorkerTime)
+	t.ClrTime += float64(s.ClrTime)
+	t.Rows += float64(s.Rows)
 }
 
+// QueryInfo describes a statement tracked by the SQL statistics collector.
+type QueryInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Database    string    `json:"database"`
+	QueryHashes []string  `json:"query_hashes"`
+	PlanHashes  []string  `json:"plan_hashes"`
+	Text        string    `json:"text"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// ScrapeSQLStat exports counters of the top statements by fingerprint and database,
+// the executions of the other statements of the plans read are summed up with fingerprint "other".
+// Only the sqlStatMaxRows plans with the highest order-by values are read, so other
+// does not include every execution of the instance.
+// A statement leaving the top is no longer exported, its counters continue from their
+// last value when it returns.
+// Plans of statements differing only in literals, and recompiled plans, share a fingerprint.
 type ScrapeSQLStat struct {
-	lastTime time.Time
-	sqlmap   map[string]SQLStat
+	mu         sync.Mutex
+	lastServer time.Time
+	sqlmap     map[string]SQLStat
+	totals     map[string]*sqlStatTotal
+	// other accumulates the executions of statements read outside the top statements,
+	// so its counters never decrease when statements enter or leave the top.
+	other sqlStatCounters
 }
 
-func (ScrapeSQLStat) Name() string {
+func (*ScrapeSQLStat) Name() string {
 	return "mssql_sql_stat"
 }
 
-func (ScrapeSQLStat) Help() string {
+func (*ScrapeSQLStat) Help() string {
 	return "collect sql executions statistics from sys.dm_exec_query_stats"
 
 }
 
-func (ScrapeSQLStat) Version() float64 {
-	return 10.2
+func (*ScrapeSQLStat) Version() float64 {
+	return 10.0
 }
 
 func (s *ScrapeSQLStat) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
-	duration := time.Since(s.lastTime)
-	if duration < intervalSQLStat {
-		return nil
-	}
-
-	sqls, err := getTopSql(ctx, dbcli)
+	sqls, err := getTopSql(ctx, dbcli, ins, *sqlStatOrderBy)
 	if err != nil {
-		return nil
+		return err
 	}
-	currentTime := time.Now()
+
+	s.update(sqls, time.Now(), ch)
+	return nil
+}
+
+// update adds the executions since the last scrape to the statement counters and sends them to ch.
+func (s *ScrapeSQLStat) update(sqls []SQLStat, now time.Time, ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	if s.sqlmap == nil {
-		s.lastTime = currentTime
-		s.sqlmap = buildSQLMap(sqls)
-		return nil
+		s.sqlmap = make(map[string]SQLStat)
+		s.totals = make(map[string]*sqlStatTotal)
+		s.updateBaseline(sqls)
+		return
 	}
 
-	for _, c := range sqls {
-		var sqlStat SQLStat
-		hkey := getQueryDigest(c)
+	deltas := make(map[string]SQLStat)
+	for i := range sqls {
+		c := &sqls[i]
+		hkey := getQueryDigest(*c)
 		prevSQL, ok := s.sqlmap[hkey]
 		if ok {
-			sqlStat = getSQLStatDiff(c, prevSQL)
+			c.Fingerprint = prevSQL.Fingerprint
+		} else {
+			c.Fingerprint = Fingerprint(c.SQLText)
+		}
+
+		var sqlStat SQLStat
+		if ok {
+			sqlStat = getSQLStatDiff(*c, prevSQL)
+		} else if !c.CreationTime.Before(s.lastServer) {
+			// compiled since the last scrape, all executions are new
+			sqlStat = *c
+		} else {
+			// older entry entering the result set, only a baseline
+			continue
+		}
+
+		key := c.Fingerprint + "/" + c.DBName
+		total, ok := s.totals[key]
+		if !ok {
+			total = &sqlStatTotal{Fingerprint: c.Fingerprint, Database: c.DBName, Text: NormalizeSQL(c.SQLText),
+				QueryHashes: make(map[string]time.Time), PlanHashes: make(map[string]time.Time)}
+			s.totals[key] = total
+		}
+		total.QueryHashes[c.QueryHash] = now
+		total.PlanHashes[c.PlanHash] = now
+		total.LastSeen = now
+		deltas[key] = addSQLStat(deltas[key], sqlStat)
+	}
+
+	for key, delta := range deltas {
+		s.totals[key].add(delta)
+	}
+	top := s.topStatements(*sqlStatLimit, sqlStatOrder[*sqlStatOrderBy])
+	for key, delta := range deltas {
+		if top[key] {
+			s.totals[key].Exported.add(delta)
 		} else {
-			sqlStat = c
+			s.other.add(delta)
 		}
+	}
 
-		if sqlStat.ExecutionCount > 0 {
-			ch <- prometheus.MustNewConstMetric(
-				sqlStatDesc, prometheus.GaugeValue, 1,
-				c.QueryHash, c.CreationTime, formatTime(s.lastTime), formatTime(currentTime), c.SQLText, c.DBName,
-				formatInt64(sqlStat.LogicalReads),
-				formatInt64(sqlStat.PhysicalReads),
-				formatInt64(sqlStat.ElapsedTime),
-				formatInt64(sqlStat.WorkerTime),
-				formatInt64(sqlStat.ClrTime),
-				formatInt64(sqlStat.Rows),
-				formatInt64(sqlStat.ExecutionCount),
-			)
+	s.updateBaseline(sqls)
+	s.prune(now)
+
+	for key := range top {
+		t := s.totals[key]
+		if t == nil {
+			continue
+		}
+		sendSQLStat(ch, &t.Exported, t.Fingerprint, t.Database)
+		for hash := range t.QueryHashes {
+			ch <- prometheus.MustNewConstMetric(sqlStatQueryHashDesc, prometheus.GaugeValue, 1, t.Fingerprint, t.Database, hash)
 		}
 	}
+	sendSQLStat(ch, &s.other, sqlStatOther, "")
+	ch <- prometheus.MustNewConstMetric(sqlStatTrackedDesc, prometheus.GaugeValue, float64(len(s.totals)))
+}
 
-	s.lastTime = currentTime
-	s.sqlmap = buildSQLMap(sqls)
+// topStatements returns the keys of the limit statements with the highest value.
+func (s *ScrapeSQLStat) topStatements(limit int, value func(*sqlStatTotal) float64) map[string]bool {
+	keys := make([]string, 0, len(s.totals))
+	for key := range s.totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return value(s.totals[keys[i]]) > value(s.totals[keys[j]])
+	})
 
-	return nil
+	result := make(map[string]bool)
+	for i := 0; i < limit && i < len(keys); i++ {
+		result[keys[i]] = true
+	}
+	return result
+}
+
+// updateBaseline keeps the counters of every plan of the last result, entries missing
+// from the result are kept for sqlStatRetention so they have a baseline when they return.
+func (s *ScrapeSQLStat) updateBaseline(sqls []SQLStat) {
+	for _, c := range sqls {
+		if c.Fingerprint == "" {
+			c.Fingerprint = Fingerprint(c.SQLText)
+		}
+		s.sqlmap[getQueryDigest(c)] = c
+		if c.ServerTime.After(s.lastServer) {
+			s.lastServer = c.ServerTime
+		}
+	}
+	for key, c := range s.sqlmap {
+		if s.lastServer.Sub(c.ServerTime) > sqlStatRetention {
+			delete(s.sqlmap, key)
+		}
+	}
+}
+
+// prune removes statements not seen for sqlStatRetention, and the least recently
+// seen ones when more than sqlStatMaxTracked are tracked. Their executions while
+// outside the top statements are already part of other. The hashes of the remaining
+// statements are pruned the same way.
+func (s *ScrapeSQLStat) prune(now time.Time) {
+	var keys []string
+	for key, t := range s.totals {
+		if now.Sub(t.LastSeen) > sqlStatRetention {
+			delete(s.totals, key)
+			continue
+		}
+		pruneHashes(t.QueryHashes, now)
+		pruneHashes(t.PlanHashes, now)
+		keys = append(keys, key)
+	}
+
+	if len(keys) <= sqlStatMaxTracked {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.totals[keys[i]].LastSeen.Before(s.totals[keys[j]].LastSeen)
+	})
+	for _, key := range keys[:len(keys)-sqlStatMaxTracked] {
+		delete(s.totals, key)
+	}
+}
+
+// pruneHashes removes the hashes not seen for sqlStatRetention, and the least recently
+// seen ones when more than sqlStatMaxHashes are left.
+func pruneHashes(hashes map[string]time.Time, now time.Time) {
+	var keys []string
+	for hash, seen := range hashes {
+		if now.Sub(seen) > sqlStatRetention {
+			delete(hashes, hash)
+			continue
+		}
+		keys = append(keys, hash)
+	}
+
+	if len(keys) <= sqlStatMaxHashes {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return hashes[keys[i]].Before(hashes[keys[j]])
+	})
+	for _, hash := range keys[:len(keys)-sqlStatMaxHashes] {
+		delete(hashes, hash)
+	}
+}
+
+// Queries returns the tracked statements with the fingerprint or query hash, which is matched
+// case insensitive and with or without the 0x prefix.
+func (s *ScrapeSQLStat) Queries(hash string) []QueryInfo {
+	hash = strings.TrimPrefix(strings.ToLower(hash), "0x")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []QueryInfo
+	for _, t := range s.totals {
+		if _, ok := t.QueryHashes[hash]; t.Fingerprint != hash && !ok {
+			continue
+		}
+		result = append(result, QueryInfo{
+			Fingerprint: t.Fingerprint,
+			Database:    t.Database,
+			QueryHashes: sortedKeys(t.QueryHashes),
+			PlanHashes:  sortedKeys(t.PlanHashes),
+			Text:        t.Text,
+			LastSeen:    t.LastSeen,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Database < result[j].Database })
+	return result
 }
 
+func sortedKeys(m map[string]time.Time) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sendSQLStat(ch chan<- prometheus.Metric, t *sqlStatCounters, fingerprint, database string) {
+	ch <- prometheus.MustNewConstMetric(sqlStatExecutionsDesc, prometheus.CounterValue, t.ExecutionCount, fingerprint, database)
+	ch <- prometheus.MustNewConstMetric(sqlStatLogicalReadsDesc, prometheus.CounterValue, t.LogicalReads, fingerprint, database)
+	ch <- prometheus.MustNewConstMetric(sqlStatPhysicalReadsDesc, prometheus.CounterValue, t.PhysicalReads, fingerprint, database)
+	ch <- prometheus.MustNewConstMetric(sqlStatCPUDesc, prometheus.CounterValue, t.WorkerTime/1e6, fingerprint, database)
+	ch <- prometheus.MustNewConstMetric(sqlStatElapsedDesc, prometheus.CounterValue, t.ElapsedTime/1e6, fingerprint, database)
+	ch <- prometheus.MustNewConstMetric(sqlStatCLRDesc, prometheus.CounterValue, t.ClrTime/1e6, fingerprint, database)
+	ch <- prometheus.MustNewConstMetric(sqlStatRowsDesc, prometheus.CounterValue, t.Rows, fingerprint, database)
+}
+
+func addSQLStat(a SQLStat, b SQLStat) SQLStat {
+	a.ExecutionCount += b.ExecutionCount
+	a.LogicalReads += b.LogicalReads
+	a.PhysicalReads += b.PhysicalReads
+	a.ElapsedTime += b.ElapsedTime
+	a.WorkerTime += b.WorkerTime
+	a.ClrTime += b.ClrTime
+	a.Rows += b.Rows
+	return a
+}
+
+// getSQLStatDiff returns the executions of a plan between prev and current. A plan whose
+// execution count went down was evicted and compiled again in between, its current
+// counters are all new executions. No counter of the result is negative.
 func getSQLStatDiff(current SQLStat, prev SQLStat) SQLStat {
+	if current.ExecutionCount < prev.ExecutionCount {
+		prev = SQLStat{}
+	}
+
 	result := SQLStat{}
-	result.LogicalReads = current.LogicalReads - prev.LogicalReads
-	result.PhysicalReads = current.PhysicalReads - prev.PhysicalReads
-	result.ElapsedTime = current.ElapsedTime - prev.ElapsedTime
-	result.WorkerTime = current.WorkerTime - prev.WorkerTime
-	result.ClrTime = current.ClrTime - prev.ClrTime
-	result.Rows = current.Rows - prev.Rows
-	result.ExecutionCount = current.ExecutionCount - prev.ExecutionCount
+	result.LogicalReads = nonNegative(current.LogicalReads - prev.LogicalReads)
+	result.PhysicalReads = nonNegative(current.PhysicalReads - prev.PhysicalReads)
+	result.ElapsedTime = nonNegative(current.ElapsedTime - prev.ElapsedTime)
+	result.WorkerTime = nonNegative(current.WorkerTime - prev.WorkerTime)
+	result.ClrTime = nonNegative(current.ClrTime - prev.ClrTime)
+	result.Rows = nonNegative(current.Rows - prev.Rows)
+	result.ExecutionCount = nonNegative(current.ExecutionCount - prev.ExecutionCount)
 
 	return result
 }
 
-func getTopSql(ctx context.Context, dbcli *dbutil.MSSQLClient) ([]SQLStat, error) {
-	sql := `SELECT TOP 500 query_hash, creation_time,
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func getTopSql(ctx context.Context, dbcli *dbutil.MSSQLClient, ins *InstanceInfoAll, orderBy string) ([]SQLStat, error) {
+	// total_rows is available from 2008R2
+	totalRows := "qs.total_rows"
+	order := sqlStatOrderColumns[orderBy]
+	if !ins.ServerVersion.AtLeast(10, 50) {
+		totalRows = "0 AS total_rows"
+		if orderBy == "rows" {
+			order = sqlStatOrderColumns["cpu"]
+		}
+	}
+
+	sql := `SELECT TOP ` + strconv.Itoa(sqlStatMaxRows) + ` query_hash, query_plan_hash, plan_handle,
+  qs.statement_start_offset, qs.statement_end_offset, creation_time, GETDATE() AS server_time,
   qs.execution_count,
   (qs.total_logical_reads + qs.total_logical_writes) as total_logical_reads,
   qs.total_physical_reads,
   qs.total_elapsed_time,
   qs.total_worker_time,
   qs.total_clr_time,
-  qs.total_rows,
-  SUBSTRING (qt.text,(qs.statement_start_offset/2) + 1,  
-    ((CASE WHEN qs.statement_end_offset = -1 
+  ` + totalRows + `,
+  SUBSTRING (qt.text,(qs.statement_start_offset/2) + 1,
+    ((CASE WHEN qs.statement_end_offset = -1
     THEN LEN(CONVERT(NVARCHAR(MAX), qt.text)) * 2
 	ELSE qs.statement_end_offset
 	END - qs.statement_start_offset)/2) + 1) AS query_text,
   ISNULL(DB_NAME(qt.dbid), '') AS DatabaseName
 FROM sys.dm_exec_query_stats qs
 CROSS APPLY sys.dm_exec_sql_text(qs.sql_handle) as qt
+ORDER BY ` + order + ` DESC
 `
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var result []SQLStat
+	err := selectRows(ctx, dbcli, &result, sql)
 	if err != nil {
 		return nil, err
 	}
-
-	var result []SQLStat
-	for _, r := range rows {
-		sqlstat := SQLStat{
-			QueryHash:      formatNullableByteArray(r[0].([]uint8)),
-			CreationTime:   formatTime(r[1].(time.Time)),
-			ExecutionCount: r[2].(int64),
-			LogicalReads:   r[3].(int64),
-			PhysicalReads:  r[4].(int64),
-			ElapsedTime:    r[5].(int64),
-			WorkerTime:     r[6].(int64),
-			ClrTime:        r[7].(int64),
-			Rows:           r[8].(int64),
-			SQLText:        r[9].(string),
-			DBName:         r[10].(string),
-		}
-
-		result = append(result, sqlstat)
-	}
 	return result, nil
 }
 
-func buildSQLMap(sqls []SQLStat) map[string]SQLStat {
-	result := make(map[string]SQLStat)
-	for _, s := range sqls {
-		hkey := getQueryDigest(s)
-		result[hkey] = s
-	}
-	return result
-}
-
+// getQueryDigest identifies a statement of a cached plan, a recompiled plan gets a new digest.
 func getQueryDigest(s SQLStat) string {
-	return s.SQLText + "/" + s.QueryHash + "/" + s.CreationTime
+	return fmt.Sprintf("%s/%d/%d/%s", s.PlanHandle, s.StatementStart, s.StatementEnd, s.CreationTime.Format(time.RFC3339Nano))
 }
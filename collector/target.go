@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	instanceInfoTTL = time.Minute
+)
+
+// Target is a monitored SQL Server instance with its own set of scrapers,
+// scrapers keep state between scrapes so they can not be shared by targets.
+// The connection pool of the target is shared by all scrapes.
+type Target struct {
+	Name     string
+	dbclient *dbutil.MSSQLClient
+	metrics  Metrics
+
+	// scrapers and scheduler are replaced by Update
+	mu        sync.RWMutex
+	scrapers  []Scraper
+	scheduler *scheduler
+
+	infoMu   sync.Mutex
+	info     *InstanceInfoAll
+	infoTime time.Time
+}
+
+func NewTarget(name string, c dbutil.MSSQLConfig, scrapers []Scraper, settings map[string]Settings) *Target {
+	t := &Target{
+		Name:     name,
+		scrapers: scrapers,
+		dbclient: dbutil.NewMSSQLClientWithConfig(c),
+		metrics:  NewMetrics(),
+	}
+	t.scheduler = newScheduler(t, settings)
+	t.scheduler.prepare(scrapers)
+	return t
+}
+
+// Start runs the scrapers of the target in the background.
+func (t *Target) Start() {
+	s, scrapers := t.current()
+	s.start(scrapers)
+}
+
+// Close stops the scrapers and closes the connection pool of the target.
+func (t *Target) Close() error {
+	s, _ := t.current()
+	s.stop()
+	return t.dbclient.CloseConnection()
+}
+
+// Update applies a reloaded config to a started target and restarts its scrapers.
+// Scrapers which were already running keep their state, last result and schedule,
+// the connection pool is reopened when the connection config changed.
+// Update waits for the running scrapes to be cancelled, so a scraper never runs twice at once.
+func (t *Target) Update(c dbutil.MSSQLConfig, scrapers []Scraper, settings map[string]Settings) {
+	old, oldScrapers := t.current()
+	old.stop()
+
+	if t.dbclient.SetConfig(c) {
+		log.WithFields(log.Fields{"target": t.Name}).Info("Connection config changed, reopen connection pool")
+		t.infoMu.Lock()
+		t.info = nil
+		t.infoMu.Unlock()
+	}
+
+	kept := make(map[string]bool)
+	for _, scraper := range scrapers {
+		kept[scraper.Name()] = true
+	}
+	for _, scraper := range oldScrapers {
+		if !kept[scraper.Name()] {
+			t.metrics.ScrapeErrors.DeleteLabelValues(scraper.Name())
+			t.metrics.CollectorDuration.DeleteLabelValues(scraper.Name())
+			t.metrics.CollectorSuccess.DeleteLabelValues(scraper.Name())
+			t.metrics.SkippedRows.DeleteLabelValues(scraper.Name())
+		}
+	}
+
+	s := newScheduler(t, settings)
+	s.inherit(old, scrapers)
+	s.prepare(scrapers)
+
+	t.mu.Lock()
+	t.scrapers = scrapers
+	t.scheduler = s
+	t.mu.Unlock()
+
+	s.start(scrapers)
+}
+
+// current returns the scheduler and scrapers of the target.
+func (t *Target) current() (*scheduler, []Scraper) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.scheduler, t.scrapers
+}
+
+// Scrapers returns the scrapers of the target.
+func (t *Target) Scrapers() []Scraper {
+	_, scrapers := t.current()
+	return scrapers
+}
+
+// instanceInfo returns the instance info, it is cached for instanceInfoTTL.
+func (t *Target) instanceInfo(ctx context.Context) (*InstanceInfoAll, error) {
+	t.infoMu.Lock()
+	defer t.infoMu.Unlock()
+
+	if t.info != nil && time.Since(t.infoTime) < instanceInfoTTL {
+		return t.info, nil
+	}
+
+	err := t.dbclient.Ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := getInstanceInfo(ctx, t.dbclient)
+	if err != nil {
+		return nil, err
+	}
+
+	t.info = info
+	t.infoTime = time.Now()
+	return info, nil
+}
+
+// FilterScrapers returns the scrapers of the target whose name is in names,
+// all scrapers are returned when names is empty.
+func (t *Target) FilterScrapers(names []string) []Scraper {
+	scrapers := t.Scrapers()
+	if len(names) == 0 {
+		return scrapers
+	}
+
+	filters := make(map[string]bool)
+	for _, name := range names {
+		filters[name] = true
+	}
+
+	var result []Scraper
+	for _, scraper := range scrapers {
+		if filters[scraper.Name()] {
+			result = append(result, scraper)
+		}
+	}
+	return result
+}
+
+// Queries returns the statements with the query hash tracked by the SQL statistics collector,
+// ok is false when the collector is not enabled for the target.
+func (t *Target) Queries(hash string) (queries []QueryInfo, ok bool) {
+	for _, scraper := range t.Scrapers() {
+		if s, isSQLStat := scraper.(*ScrapeSQLStat); isSQLStat {
+			return s.Queries(hash), true
+		}
+	}
+	return nil, false
+}
+
+// Deadlocks returns the deadlock graphs archived by the deadlock collector, the most recent first,
+// ok is false when the collector is not enabled for the target.
+func (t *Target) Deadlocks() (deadlocks []Deadlock, ok bool) {
+	for _, scraper := range t.Scrapers() {
+		if s, isDeadlock := scraper.(*ScrapeDeadlock); isDeadlock {
+			return s.Deadlocks(), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,183 @@
+package collector
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+var (
+	tempdbSessionLimit = kingpin.Flag(
+		"collect.mssql_tempdb.session-limit",
+		"Number of sessions using the most tempdb space exported by mssql_tempdb.",
+	).Default("10").Int()
+
+	tempdbSpaceDesc = newDesc("tempdb", "space_bytes",
+		"Space of the tempdb data files by usage: user_objects, internal_objects, version_store, mixed_extents or unallocated.",
+		[]string{"type"})
+
+	tempdbSessionLabels = []string{"session_id", "login_name", "host_name", "program_name"}
+
+	tempdbSessionUserObjectsDesc = newDesc("tempdb", "session_user_objects_bytes",
+		"Tempdb space allocated for user objects by the session and its running tasks, not yet deallocated.",
+		tempdbSessionLabels)
+
+	tempdbSessionInternalObjectsDesc = newDesc("tempdb", "session_internal_objects_bytes",
+		"Tempdb space allocated for internal objects by the session and its running tasks, not yet deallocated.",
+		tempdbSessionLabels)
+
+	tempdbFileLabels = []string{"file", "type"}
+
+	tempdbFileDescs = newFileSettingsDescs("tempdb", "tempdb file", tempdbFileLabels)
+
+	tempdbDataFilesDesc = newDesc("tempdb", "data_files",
+		"Number of tempdb data files.",
+		nil)
+
+	tempdbDataFilesBalancedDesc = newDesc("tempdb", "data_files_balanced",
+		"Whether all tempdb data files have the same size and growth settings, so allocations are spread evenly.",
+		nil)
+)
+
+type tempdbSpaceRow struct {
+	UserObjects     float64 `db:"user_objects"`
+	InternalObjects float64 `db:"internal_objects"`
+	VersionStore    float64 `db:"version_store"`
+	MixedExtents    float64 `db:"mixed_extents"`
+	Unallocated     float64 `db:"unallocated"`
+}
+
+type tempdbSessionRow struct {
+	SessionID       int64   `db:"session_id"`
+	LoginName       string  `db:"login_name,nullable"`
+	HostName        string  `db:"host_name,nullable"`
+	ProgramName     string  `db:"program_name,nullable"`
+	UserObjects     float64 `db:"user_objects"`
+	InternalObjects float64 `db:"internal_objects"`
+}
+
+// ScrapeTempdb collects the space usage of tempdb, the sessions using most of it and its file layout.
+type ScrapeTempdb struct{}
+
+func (ScrapeTempdb) Name() string {
+	return "mssql_tempdb"
+}
+
+func (ScrapeTempdb) Help() string {
+	return "collect tempdb space usage, top consuming sessions and tempdb files"
+}
+
+func (ScrapeTempdb) Version() float64 {
+	return 10.0
+}
+
+func (s *ScrapeTempdb) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
+	err := s.scrapeSpace(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+	err = s.scrapeSessions(ctx, dbcli, ch)
+	if err != nil {
+		return err
+	}
+	return s.scrapeFiles(ctx, dbcli, ch)
+}
+
+func (s *ScrapeTempdb) scrapeSpace(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	sql := `SELECT SUM(user_object_reserved_page_count) * 8192 AS user_objects,
+  SUM(internal_object_reserved_page_count) * 8192 AS internal_objects,
+  SUM(version_store_reserved_page_count) * 8192 AS version_store,
+  SUM(mixed_extent_page_count) * 8192 AS mixed_extents,
+  SUM(unallocated_extent_page_count) * 8192 AS unallocated
+FROM tempdb.sys.dm_db_file_space_usage
+`
+	var rows []tempdbSpaceRow
+	err := selectRows(ctx, dbcli, &rows, sql)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		ch <- prometheus.MustNewConstMetric(tempdbSpaceDesc, prometheus.GaugeValue, r.UserObjects, "user_objects")
+		ch <- prometheus.MustNewConstMetric(tempdbSpaceDesc, prometheus.GaugeValue, r.InternalObjects, "internal_objects")
+		ch <- prometheus.MustNewConstMetric(tempdbSpaceDesc, prometheus.GaugeValue, r.VersionStore, "version_store")
+		ch <- prometheus.MustNewConstMetric(tempdbSpaceDesc, prometheus.GaugeValue, r.MixedExtents, "mixed_extents")
+		ch <- prometheus.MustNewConstMetric(tempdbSpaceDesc, prometheus.GaugeValue, r.Unallocated, "unallocated")
+	}
+	return nil
+}
+
+func (s *ScrapeTempdb) scrapeSessions(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// sys.dm_db_session_space_usage only counts the pages of completed tasks, the pages of
+	// running tasks are in sys.dm_db_task_space_usage; a session may deallocate pages
+	// allocated by another one, so the difference can be negative
+	sql := `WITH usage AS (
+  SELECT ss.session_id,
+    ss.user_objects_alloc_page_count - ss.user_objects_dealloc_page_count
+      + ISNULL(ts.user_alloc - ts.user_dealloc, 0) AS user_pages,
+    ss.internal_objects_alloc_page_count - ss.internal_objects_dealloc_page_count
+      + ISNULL(ts.internal_alloc - ts.internal_dealloc, 0) AS internal_pages
+  FROM sys.dm_db_session_space_usage ss
+  LEFT JOIN (
+    SELECT session_id,
+      SUM(user_objects_alloc_page_count) AS user_alloc, SUM(user_objects_dealloc_page_count) AS user_dealloc,
+      SUM(internal_objects_alloc_page_count) AS internal_alloc, SUM(internal_objects_dealloc_page_count) AS internal_dealloc
+    FROM sys.dm_db_task_space_usage
+    GROUP BY session_id
+  ) ts ON ts.session_id = ss.session_id
+)
+SELECT TOP (@p1) u.session_id, es.login_name, es.host_name, es.program_name,
+  CASE WHEN u.user_pages > 0 THEN u.user_pages ELSE 0 END * 8192 AS user_objects,
+  CASE WHEN u.internal_pages > 0 THEN u.internal_pages ELSE 0 END * 8192 AS internal_objects
+FROM usage u
+JOIN sys.dm_exec_sessions es ON es.session_id = u.session_id
+WHERE u.user_pages > 0 OR u.internal_pages > 0
+ORDER BY CASE WHEN u.user_pages > 0 THEN u.user_pages ELSE 0 END
+  + CASE WHEN u.internal_pages > 0 THEN u.internal_pages ELSE 0 END DESC
+`
+	var rows []tempdbSessionRow
+	err := selectRows(ctx, dbcli, &rows, sql, *tempdbSessionLimit)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		labels := []string{formatInt64(r.SessionID), r.LoginName, r.HostName, r.ProgramName}
+		ch <- prometheus.MustNewConstMetric(tempdbSessionUserObjectsDesc, prometheus.GaugeValue, r.UserObjects, labels...)
+		ch <- prometheus.MustNewConstMetric(tempdbSessionInternalObjectsDesc, prometheus.GaugeValue, r.InternalObjects, labels...)
+	}
+	return nil
+}
+
+func (s *ScrapeTempdb) scrapeFiles(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric) error {
+	// sys.master_files has the startup size of the tempdb files, the current size is in
+	// tempdb.sys.database_files
+	rows, err := selectFileSettings(ctx, dbcli, "N'tempdb'", "FROM tempdb.sys.database_files f")
+	if err != nil {
+		return err
+	}
+
+	dataFiles := 0
+	balanced := true
+	var first *fileSettingsRow
+	for i, r := range rows {
+		tempdbFileDescs.send(ch, r, r.FileName, r.TypeDesc)
+
+		if r.TypeDesc != "ROWS" {
+			continue
+		}
+		dataFiles++
+		if first == nil {
+			first = &rows[i]
+		} else if r.Size != first.Size || r.Growth != first.Growth || r.IsPercentGrowth != first.IsPercentGrowth ||
+			r.MaxSize != first.MaxSize {
+			balanced = false
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(tempdbDataFilesDesc, prometheus.GaugeValue, float64(dataFiles))
+	ch <- prometheus.MustNewConstMetric(tempdbDataFilesBalancedDesc, prometheus.GaugeValue, boolToFloat(balanced))
+	return nil
+}
@@ -9,28 +9,30 @@ import (
 )
 
 var (
-	waitStatWaitingTasksDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "waitstat", "waiting_tasks"),
+	waitStatWaitingTasksDesc = newDesc("waitstat", "waiting_tasks",
 		"MSSQL Instance Info",
-		[]string{"wait_type"}, nil)
+		[]string{"wait_type"})
 
-	waitStatWaitTimeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "waitstat", "wait_time_ms"),
+	waitStatWaitTimeDesc = newDesc("waitstat", "wait_time_ms",
 		"MSSQL Instance Info",
-		[]string{"wait_type"}, nil)
+		[]string{"wait_type"})
 
-	waitStatSignalWaitTimeDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "waitstat", "signal_wait_time_ms"),
+	waitStatSignalWaitTimeDesc = newDesc("waitstat", "signal_wait_time_ms",
 		"MSSQL Instance Info",
-		[]string{"wait_type"}, nil)
+		[]string{"wait_type"})
 
 	intervalWaitStat = 5 * time.Second
 )
 
-type ScrapeWaitStat struct {
-	lastTime time.Time
+type waitStatRow struct {
+	WaitType          string  `db:"wait_type"`
+	WaitingTasksCount float64 `db:"waiting_tasks_count"`
+	SignalWaitTimeMs  float64 `db:"signal_wait_time_ms"`
+	WaitTimeMs        float64 `db:"wait_time_ms"`
 }
 
+type ScrapeWaitStat struct{}
+
 func (ScrapeWaitStat) Name() string {
 	return "mssql_wait_stat"
 }
@@ -41,15 +43,10 @@ func (ScrapeWaitStat) Help() string {
 }
 
 func (ScrapeWaitStat) Version() float64 {
-	return 10.2
+	return 10.0
 }
 
 func (s *ScrapeWaitStat) Scrape(ctx context.Context, dbcli *dbutil.MSSQLClient, ch chan<- prometheus.Metric, ins *InstanceInfoAll) error {
-	duration := time.Since(s.lastTime)
-	if duration < intervalWaitStat {
-		return nil
-	}
-
 	sql := `SELECT wait_type,
     SUM (waiting_tasks_count) AS waiting_tasks_count, 
     SUM (signal_wait_time_ms) AS signal_wait_time_ms, 
@@ -160,28 +157,23 @@ where wait_type not in (
 	'XE_TIMER_EVENT')
 GROUP BY merged_wait_stats.wait_type`
 
-	rows, err := dbcli.FetchRowsWithContext(ctx, sql)
+	var rows []waitStatRow
+	err := selectRows(ctx, dbcli, &rows, sql)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	currentTime := time.Now()
-
 	for _, r := range rows {
-		waitType := r[0].(string)
-
 		ch <- prometheus.MustNewConstMetric(
-			waitStatWaitingTasksDesc, prometheus.CounterValue, float64(r[1].(int64)), waitType)
+			waitStatWaitingTasksDesc, prometheus.CounterValue, r.WaitingTasksCount, r.WaitType)
 
 		ch <- prometheus.MustNewConstMetric(
-			waitStatWaitTimeDesc, prometheus.CounterValue, float64(r[2].(int64)), waitType)
+			waitStatWaitTimeDesc, prometheus.CounterValue, r.WaitTimeMs, r.WaitType)
 
 		ch <- prometheus.MustNewConstMetric(
-			waitStatSignalWaitTimeDesc, prometheus.CounterValue, float64(r[3].(int64)), waitType)
+			waitStatSignalWaitTimeDesc, prometheus.CounterValue, r.SignalWaitTimeMs, r.WaitType)
 
 	}
 
-	s.lastTime = currentTime
-
 	return nil
 }
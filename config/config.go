@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"yunche.pro/dtsre/mssql_exporter/collector"
+	"yunche.pro/dtsre/mssql_exporter/dbutil"
+)
+
+const (
+	// DefaultTargetName is the target a legacy single instance config file is loaded as,
+	// it is also the target served on the metrics path.
+	DefaultTargetName = "default"
+)
+
+// Target is one monitored SQL Server instance.
+type Target struct {
+	Name               string `yaml:"name"`
+	dbutil.MSSQLConfig `yaml:",inline"`
+	// Collectors enabled for this target, all collectors enabled by flags are used when empty.
+	Collectors []string `yaml:"collectors"`
+}
+
+// Config is the content of the exporter config file.
+//
+//	targets:
+//	  - name: db1
+//	    host: 172.16.121.235
+//	    port: 1433
+//	    username: monitor
+//	    password: xxx
+//	    collectors: [mssql_instance_info, mssql_perfcounter]
+//	collector_settings:
+//	  mssql_db_backup:
+//	    interval: 10m
+//	    timeout: 1m
+//	  mssql_sql_stat:
+//	    enabled: true
+//
+// A file with only host, port, username, password and instance on top level
+// is loaded as a single target named "default".
+type Config struct {
+	Targets []Target `yaml:"targets"`
+	// CollectorSettings overrides the scrape interval, timeout and enablement of collectors by name.
+	CollectorSettings map[string]collector.Settings `yaml:"collector_settings"`
+	// Queries are user defined collectors, see collector.QueryConfig.
+	Queries []collector.QueryConfig `yaml:"queries"`
+}
+
+func Load(configFile string) (*Config, error) {
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	err = yaml.Unmarshal(buf, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Targets) == 0 {
+		var legacy dbutil.MSSQLConfig
+		err = yaml.Unmarshal(buf, &legacy)
+		if err != nil {
+			return nil, err
+		}
+		if legacy.Host != "" {
+			c.Targets = append(c.Targets, Target{Name: DefaultTargetName, MSSQLConfig: legacy})
+		}
+	}
+
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	names := make(map[string]bool)
+	for i, t := range c.Targets {
+		if t.Name == "" {
+			return fmt.Errorf("target #%d has no name", i+1)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.Host == "" {
+			return fmt.Errorf("target %q has no host", t.Name)
+		}
+		err := t.MSSQLConfig.Validate()
+		if err != nil {
+			return fmt.Errorf("target %q: %w", t.Name, err)
+		}
+		if t.MultiSubnetFailover {
+			log.WithFields(log.Fields{"target": t.Name}).Warn("multi_subnet_failover has no effect, go-mssqldb always connects to all addresses of the host in parallel")
+		}
+	}
+
+	for name, settings := range c.CollectorSettings {
+		if settings.Interval < 0 || settings.Timeout < 0 {
+			return fmt.Errorf("collector %q has a negative interval or timeout", name)
+		}
+	}
+
+	queries := make(map[string]bool)
+	metrics := make(map[string]string)
+	for _, q := range c.Queries {
+		err := q.Validate()
+		if err != nil {
+			return err
+		}
+		if queries[q.Name] {
+			return fmt.Errorf("duplicate query name %q", q.Name)
+		}
+		queries[q.Name] = true
+
+		for _, name := range q.MetricNames() {
+			if other, ok := metrics[name]; ok {
+				return fmt.Errorf("queries %q and %q both have metric %s", other, q.Name, name)
+			}
+			metrics[name] = q.Name
+		}
+
+		if _, ok := c.CollectorSettings[q.Name]; !ok {
+			if c.CollectorSettings == nil {
+				c.CollectorSettings = make(map[string]collector.Settings)
+			}
+			c.CollectorSettings[q.Name] = q.Settings()
+		}
+	}
+	return nil
+}
+
+// Target returns the target with the given name.
+func (c *Config) Target(name string) (Target, bool) {
+	for _, t := range c.Targets {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
@@ -0,0 +1,307 @@
+package dbutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// fieldMapping maps a column of the result set to a struct field.
+type fieldMapping struct {
+	index    int
+	column   string
+	nullable bool
+}
+
+// Select runs the query and appends one element to dest for every row, dest must be
+// a pointer to a slice of structs.
+//
+// Columns are matched to struct fields by the `db` tag, or by the lower case field name.
+// NULL is accepted by pointer fields, which are left nil, and by fields tagged nullable,
+// e.g. `db:"collation_name,nullable"`, which get the zero value. Values are converted
+// between integer, float, decimal, bit, string and binary types as needed.
+//
+// Rows which can not be mapped are skipped and logged, the number of skipped rows is returned.
+func (c *MSSQLClient) Select(ctx context.Context, dest interface{}, querytext string, params ...interface{}) (int, error) {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice || slice.Elem().Type().Elem().Kind() != reflect.Struct {
+		return 0, fmt.Errorf("dest must be a pointer to a slice of structs, got %T", dest)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+
+	rs, err := c.ExecuteQueryWithContext(ctx, querytext, params...)
+	if err != nil {
+		return 0, err
+	}
+	defer rs.Close()
+
+	columnTypes, err := rs.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+
+	columns := make([]string, len(columnTypes))
+	dbtypes := make([]string, len(columnTypes))
+	for i, ct := range columnTypes {
+		columns[i] = ct.Name()
+		dbtypes[i] = ct.DatabaseTypeName()
+	}
+
+	mappings, err := mapFields(elemType, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	values := make([]interface{}, len(columnTypes))
+	for i := range values {
+		values[i] = new(interface{})
+	}
+
+	skipped := 0
+	for rs.Next() {
+		err = rs.Scan(values...)
+		if err != nil {
+			return skipped, err
+		}
+
+		elem := reflect.New(elemType).Elem()
+		err = assignRow(elem, mappings, values, dbtypes)
+		if err != nil {
+			skipped++
+			log.WithFields(log.Fields{"error": err, "query": querytext}).Warn("Skip Row")
+			continue
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return skipped, rs.Err()
+}
+
+// mapFields returns the field mapping of every column, in column order,
+// columns without a field are mapped to index -1.
+func mapFields(t reflect.Type, columns []string) ([]fieldMapping, error) {
+	fields := make(map[string]fieldMapping)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.ToLower(f.Name)
+		nullable := false
+		if tag, ok := f.Tag.Lookup("db"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = strings.ToLower(parts[0])
+			}
+			for _, opt := range parts[1:] {
+				if opt == "nullable" {
+					nullable = true
+				}
+			}
+		}
+		fields[name] = fieldMapping{index: i, column: name, nullable: nullable}
+	}
+
+	result := make([]fieldMapping, len(columns))
+	found := make(map[string]bool)
+	for i, column := range columns {
+		name := strings.ToLower(column)
+		m, ok := fields[name]
+		if !ok {
+			result[i] = fieldMapping{index: -1, column: name}
+			continue
+		}
+		result[i] = m
+		found[name] = true
+	}
+
+	for name := range fields {
+		if !found[name] {
+			return nil, fmt.Errorf("no column %q in result set for %s", name, t.Name())
+		}
+	}
+	return result, nil
+}
+
+func assignRow(elem reflect.Value, mappings []fieldMapping, values []interface{}, dbtypes []string) error {
+	for i, m := range mappings {
+		if m.index < 0 {
+			continue
+		}
+		v := *values[i].(*interface{})
+		err := assignValue(elem.Field(m.index), v, dbtypes[i], m.nullable)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", m.column, err)
+		}
+	}
+	return nil
+}
+
+func assignValue(field reflect.Value, v interface{}, dbtype string, nullable bool) error {
+	if v == nil {
+		if field.Kind() == reflect.Ptr || nullable {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		return fmt.Errorf("unexpected NULL value")
+	}
+
+	if field.Kind() == reflect.Ptr {
+		p := reflect.New(field.Type().Elem())
+		err := assignValue(p.Elem(), v, dbtype, nullable)
+		if err != nil {
+			return err
+		}
+		field.Set(p)
+		return nil
+	}
+
+	if field.Type() == timeType {
+		t, ok := v.(time.Time)
+		if !ok {
+			return fmt.Errorf("can not convert %T to time", v)
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(toStringValue(v, dbtype))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := toIntValue(v, dbtype)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloatValue(v, dbtype)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+		return nil
+	case reflect.Bool:
+		f, err := toFloatValue(v, dbtype)
+		if err != nil {
+			return err
+		}
+		field.SetBool(f != 0)
+		return nil
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			b, ok := v.([]byte)
+			if !ok {
+				return fmt.Errorf("can not convert %T to bytes", v)
+			}
+			field.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported field type %s", field.Type())
+}
+
+// isDecimal reports whether the database type is returned by the driver as decimal digits in a byte slice.
+func isDecimal(dbtype string) bool {
+	switch dbtype {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+		return true
+	}
+	return false
+}
+
+func toStringValue(v interface{}, dbtype string) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case []byte:
+		if isDecimal(dbtype) {
+			return string(vv)
+		}
+		return fmt.Sprintf("%x", vv)
+	case time.Time:
+		return vv.Format("2006-01-02 15:04:05")
+	default:
+		return fmt.Sprint(vv)
+	}
+}
+
+// toIntValue converts integers and decimals without fraction exactly, values beyond 2^53 like
+// bigint counters would lose precision as float64. Other values are truncated.
+func toIntValue(v interface{}, dbtype string) (int64, error) {
+	switch vv := v.(type) {
+	case int64:
+		return vv, nil
+	case int32:
+		return int64(vv), nil
+	case int16:
+		return int64(vv), nil
+	case int8:
+		return int64(vv), nil
+	case uint8:
+		return int64(vv), nil
+	case int:
+		return int64(vv), nil
+	case []byte:
+		if i, err := strconv.ParseInt(string(vv), 10, 64); err == nil && isDecimal(dbtype) {
+			return i, nil
+		}
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(vv), 10, 64); err == nil {
+			return i, nil
+		}
+	}
+
+	f, err := toFloatValue(v, dbtype)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f), nil
+}
+
+func toFloatValue(v interface{}, dbtype string) (float64, error) {
+	switch vv := v.(type) {
+	case int64:
+		return float64(vv), nil
+	case int32:
+		return float64(vv), nil
+	case int16:
+		return float64(vv), nil
+	case int8:
+		return float64(vv), nil
+	case uint8:
+		return float64(vv), nil
+	case int:
+		return float64(vv), nil
+	case float64:
+		return vv, nil
+	case float32:
+		return float64(vv), nil
+	case bool:
+		if vv {
+			return 1, nil
+		}
+		return 0, nil
+	case []byte:
+		if !isDecimal(dbtype) {
+			return 0, fmt.Errorf("can not convert %s to number", dbtype)
+		}
+		return strconv.ParseFloat(string(vv), 64)
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(vv), 64)
+	}
+	return 0, fmt.Errorf("can not convert %T to number", v)
+}
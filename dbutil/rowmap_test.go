@@ -0,0 +1,152 @@
+package dbutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rowmapTestRow struct {
+	Name       string   `db:"database_name"`
+	Collation  string   `db:"collation_name,nullable"`
+	Size       float64  `db:"size"`
+	Files      int64    `db:"files"`
+	ReadOnly   bool     `db:"is_read_only"`
+	Growth     *float64 `db:"growth"`
+	State      string
+	Ignored    string `db:"-"`
+	unexported string
+}
+
+func TestMapFields(t *testing.T) {
+	typ := reflect.TypeOf(rowmapTestRow{})
+
+	mappings, err := mapFields(typ, []string{"Database_Name", "collation_name", "size", "files", "is_read_only", "growth", "STATE", "extra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fieldMapping{
+		{index: 0, column: "database_name"},
+		{index: 1, column: "collation_name", nullable: true},
+		{index: 2, column: "size"},
+		{index: 3, column: "files"},
+		{index: 4, column: "is_read_only"},
+		{index: 5, column: "growth"},
+		{index: 6, column: "state"},
+		{index: -1, column: "extra"},
+	}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Errorf("mapFields() = %+v, want %+v", mappings, want)
+	}
+
+	_, err = mapFields(typ, []string{"database_name", "size"})
+	if err == nil || !strings.Contains(err.Error(), "no column") {
+		t.Errorf("mapFields() with missing columns returned error %v, want no column", err)
+	}
+}
+
+func TestAssignValue(t *testing.T) {
+	now := time.Date(2023, 5, 1, 3, 12, 8, 0, time.UTC)
+	f := 2.5
+
+	tests := []struct {
+		name     string
+		dest     interface{}
+		v        interface{}
+		dbtype   string
+		nullable bool
+		want     interface{}
+		wantErr  bool
+	}{
+		{"int to int64", new(int64), int64(42), "BIGINT", false, int64(42), false},
+		{"int32 to float", new(float64), int32(7), "INT", false, 7.0, false},
+		{"tinyint to int", new(int), uint8(3), "TINYINT", false, 3, false},
+		{"float to int64 truncates", new(int64), 3.9, "FLOAT", false, int64(3), false},
+		{"bigint to int64 exactly", new(int64), int64(9007199254740993), "BIGINT", false, int64(9007199254740993), false},
+		{"decimal to int64 exactly", new(int64), []byte("9007199254740993"), "DECIMAL", false, int64(9007199254740993), false},
+		{"decimal with fraction to int64 truncates", new(int64), []byte("12.75"), "DECIMAL", false, int64(12), false},
+		{"string to int64", new(int64), " 42 ", "VARCHAR", false, int64(42), false},
+		{"decimal to float", new(float64), []byte("123.45"), "DECIMAL", false, 123.45, false},
+		{"money to float", new(float64), []byte("-1.5000"), "MONEY", false, -1.5, false},
+		{"decimal to string", new(string), []byte("10.00"), "NUMERIC", false, "10.00", false},
+		{"bit to bool", new(bool), true, "BIT", false, true, false},
+		{"int to bool", new(bool), int64(0), "INT", false, false, false},
+		{"bool to float", new(float64), true, "BIT", false, 1.0, false},
+		{"string to string", new(string), "appdb", "NVARCHAR", false, "appdb", false},
+		{"string to float", new(float64), " 12.5 ", "VARCHAR", false, 12.5, false},
+		{"int to string", new(string), int64(5), "INT", false, "5", false},
+		{"binary to hex string", new(string), []byte{0x5f, 0x1c, 0x0f}, "BINARY", false, "5f1c0f", false},
+		{"binary to bytes", new([]byte), []byte{1, 2}, "VARBINARY", false, []byte{1, 2}, false},
+		{"time to time", new(time.Time), now, "DATETIME", false, now, false},
+		{"time to string", new(string), now, "DATETIME", false, "2023-05-01 03:12:08", false},
+		{"float to pointer", new(*float64), 2.5, "FLOAT", false, &f, false},
+		{"null to pointer", new(*float64), nil, "FLOAT", false, (*float64)(nil), false},
+		{"null to nullable", new(string), nil, "NVARCHAR", true, "", false},
+		{"null to nullable float", new(float64), nil, "FLOAT", true, 0.0, false},
+
+		{"null to not nullable", new(string), nil, "NVARCHAR", false, nil, true},
+		{"binary to float", new(float64), []byte{1}, "VARBINARY", false, nil, true},
+		{"binary to int", new(int64), []byte("1"), "VARBINARY", false, nil, true},
+		{"invalid string to float", new(float64), "abc", "VARCHAR", false, nil, true},
+		{"string to time", new(time.Time), "2023-05-01", "VARCHAR", false, nil, true},
+		{"string to bytes", new([]byte), "x", "VARCHAR", false, nil, true},
+		{"unsupported field", new(map[string]string), "x", "VARCHAR", false, nil, true},
+		{"invalid value to pointer", new(*float64), "abc", "VARCHAR", false, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := reflect.ValueOf(tt.dest).Elem()
+			err := assignValue(field, tt.v, tt.dbtype, tt.nullable)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("assignValue(%v) = %v, want error", tt.v, field.Interface())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("assignValue(%v) returned error %v", tt.v, err)
+			}
+			if got := field.Interface(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assignValue(%v) = %#v, want %#v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssignRow(t *testing.T) {
+	columns := []string{"database_name", "collation_name", "size", "files", "is_read_only", "growth", "state", "extra"}
+	dbtypes := []string{"NVARCHAR", "NVARCHAR", "DECIMAL", "INT", "BIT", "FLOAT", "NVARCHAR", "INT"}
+	mappings, err := mapFields(reflect.TypeOf(rowmapTestRow{}), columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := func(vs ...interface{}) []interface{} {
+		result := make([]interface{}, len(vs))
+		for i, v := range vs {
+			v := v
+			result[i] = &v
+		}
+		return result
+	}
+
+	var row rowmapTestRow
+	err = assignRow(reflect.ValueOf(&row).Elem(), mappings,
+		values("appdb", nil, []byte("1024.5"), int32(2), false, nil, "ONLINE", int64(1)), dbtypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rowmapTestRow{Name: "appdb", Size: 1024.5, Files: 2, State: "ONLINE"}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("assignRow() = %+v, want %+v", row, want)
+	}
+
+	// a NULL in a column which is neither a pointer nor nullable makes the row skipped
+	err = assignRow(reflect.ValueOf(&rowmapTestRow{}).Elem(), mappings,
+		values("appdb", nil, nil, int32(2), false, nil, "ONLINE", int64(1)), dbtypes)
+	if err == nil || !strings.Contains(err.Error(), "column size") {
+		t.Errorf("assignRow() with NULL size returned error %v, want column size", err)
+	}
+}
@@ -0,0 +1,91 @@
+package dbutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"yunche.pro/dtsre/mssql_exporter/logutil"
+)
+
+const (
+	redacted             = "<secret>"
+	passwordCommandLimit = 10 * time.Second
+)
+
+// validateSecret checks that the password comes from at most one source.
+func (c MSSQLConfig) validateSecret() error {
+	sources := 0
+	for _, set := range []bool{c.Password != "", c.PasswordEnv != "", c.PasswordFile != "", len(c.PasswordCommand) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("only one of password, password_env, password_file and password_command can be set")
+	}
+	return nil
+}
+
+// resolvePassword returns the password from the configured source, it is resolved
+// on every connect so rotated secrets are picked up when the pool is reopened.
+func (c MSSQLConfig) resolvePassword() (string, error) {
+	switch {
+	case c.PasswordEnv != "":
+		v, ok := os.LookupEnv(c.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", c.PasswordEnv)
+		}
+		return v, nil
+	case c.PasswordFile != "":
+		buf, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("read password file: %w", err)
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	case len(c.PasswordCommand) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), passwordCommandLimit)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, c.PasswordCommand[0], c.PasswordCommand[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("run password command %s: %w", c.PasswordCommand[0], err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return c.Password, nil
+}
+
+// String formats the config without the password, so it can be logged.
+func (c MSSQLConfig) String() string {
+	cc := c
+	if cc.Password != "" {
+		cc.Password = redacted
+	}
+	type plain MSSQLConfig
+	return fmt.Sprintf("%+v", plain(cc))
+}
+
+// Redact removes the credentials of the client from s.
+func (c *MSSQLClient) Redact(s string) string {
+	password := c.Config().Password
+	if password != "" {
+		s = strings.Replace(s, password, redacted, -1)
+	}
+	return logutil.Redact(s)
+}
+
+// redactError returns err with the credentials of the client removed from its message.
+func (c *MSSQLClient) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := c.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -65,7 +65,7 @@ func newLfsHook(logName string, logLevel string, maxRemainCnt uint) log.Hook {
 		log.ErrorLevel: writer,
 		log.FatalLevel: writer,
 		log.PanicLevel: writer,
-	}, &log.TextFormatter{DisableColors: true})
+	}, redactFormatter{&log.TextFormatter{DisableColors: true}})
 
 	return lfsHook
 }
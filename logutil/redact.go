@@ -0,0 +1,59 @@
+package logutil
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	redacted = "<secret>"
+)
+
+var (
+	// user:password@ in a URL
+	urlPasswordPattern = regexp.MustCompile(`(://[^:/@\s]*:)[^\s"']*@`)
+	// password=xxx in a connection string or URL query
+	paramPasswordPattern = regexp.MustCompile(`(?i)((?:password|pwd)=)[^;&\s]*`)
+
+	secretsMu sync.RWMutex
+	secrets   = make(map[string]bool)
+)
+
+// AddSecret registers a secret which is removed from every log line and from Redact.
+func AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	secrets[secret] = true
+	secretsMu.Unlock()
+}
+
+// Redact removes registered secrets and passwords in URLs and connection strings from s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	for secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	secretsMu.RUnlock()
+
+	s = urlPasswordPattern.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = paramPasswordPattern.ReplaceAllString(s, "${1}"+redacted)
+	return s
+}
+
+// redactFormatter removes secrets from the output of the wrapped formatter.
+type redactFormatter struct {
+	log.Formatter
+}
+
+func (f redactFormatter) Format(entry *log.Entry) ([]byte, error) {
+	out, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(Redact(string(out))), nil
+}
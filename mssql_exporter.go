@@ -1,20 +1,28 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"html/template"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"context"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"yunche.pro/dtsre/mssql_exporter/collector"
+	"yunche.pro/dtsre/mssql_exporter/config"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"yunche.pro/dtsre/mssql_exporter/logutil"
+	"yunche.pro/dtsre/mssql_exporter/web"
 )
 
 var (
@@ -32,27 +40,53 @@ var (
 		"Offset to subtract from timeout in seconds.",
 	).Default("0.25").Float64()
 
+	probePath = kingpin.Flag(
+		"web.probe-path",
+		"Path under which to expose metrics of a single target given by the target parameter.",
+	).Default("/probe").String()
+
+	webConfigFile = kingpin.Flag(
+		"web.config.file",
+		"Path to the web config file enabling TLS and basic auth, in the format of the Prometheus exporter-toolkit.",
+	).Default("").String()
+
 	configFile = kingpin.Flag("config", "exporter config file").Default("mssql_exporter.yaml").String()
 	loglevel   = kingpin.Flag("level", "exporter log level").Default("info").String()
 )
 
-var scrapers = map[collector.Scraper]bool{
-	&collector.ScrapeMSSQLInfo{}:        true,
-	&collector.ScrapeMSSQLPerfCounter{}: true,
-	&collector.ScrapeSQLStat{}:          false,
-	&collector.ScrapeWaitStat{}:         true,
-	&collector.ScrapeDbSpace{}:          true,
-	&collector.ScrapeDbBackup{}:         true,
-	&collector.ScrapeDbMeta{}:           true,
-	&collector.ScrapeDbSession{}:        true,
-	&collector.ScrapeDbMirrorState{}:    true,
-	&collector.ScrapeMSSQLConfig{}:      true,
+// newScrapers returns a new instance of every scraper and whether it is enabled by default,
+// scrapers keep state between scrapes so each target needs its own instances.
+func newScrapers() map[collector.Scraper]bool {
+	return map[collector.Scraper]bool{
+		&collector.ScrapeMSSQLInfo{}:          true,
+		&collector.ScrapeMSSQLPerfCounter{}:   true,
+		&collector.ScrapeSQLStat{}:            false,
+		&collector.ScrapeWaitStat{}:           true,
+		&collector.ScrapeDbSpace{}:            true,
+		&collector.ScrapeDbBackup{}:           true,
+		&collector.ScrapeDbMeta{}:             true,
+		&collector.ScrapeDbSession{}:          true,
+		&collector.ScrapeDbMirrorState{}:      true,
+		&collector.ScrapeMSSQLConfig{}:        true,
+		&collector.ScrapeAvailabilityGroup{}:  true,
+		&collector.ScrapeIOFile{}:             true,
+		&collector.ScrapeDbLog{}:              true,
+		&collector.ScrapeAgentJob{}:           true,
+		&collector.ScrapeMemory{}:             true,
+		&collector.ScrapeCPU{}:                true,
+		&collector.ScrapeTempdb{}:             true,
+		&collector.ScrapeDeadlock{}:           true,
+		&collector.ScrapeQueryStore{}:         false,
+		&collector.ScrapeReplication{}:        false,
+		&collector.ScrapeIndex{}:              false,
+		&collector.ScrapeIndexFragmentation{}: false,
+	}
 }
 
 func main() {
 	// Generate ON/OFF flags for all scrapers.
-	scraperFlags := map[collector.Scraper]*bool{}
-	for scraper, enabledByDefault := range scrapers {
+	scraperFlags := map[string]*bool{}
+	for scraper, enabledByDefault := range newScrapers() {
 		defaultOn := "false"
 		if enabledByDefault {
 			defaultOn = "true"
@@ -63,7 +97,7 @@ func main() {
 			scraper.Help(),
 		).Default(defaultOn).Bool()
 
-		scraperFlags[scraper] = f
+		scraperFlags[scraper.Name()] = f
 	}
 
 	kingpin.Parse()
@@ -76,22 +110,40 @@ func main() {
 <body>
 <h1>SQL Server Database exporter</h1>
 <p><a href='` + *metricPath + `'>Metrics</a></p>
+<p><a href='` + *probePath + `?target=` + config.DefaultTargetName + `'>Probe</a></p>
+<p><a href='/status'>Status</a></p>
 </body>
 </html>
 `)
 
-	enabledScrapers := []collector.Scraper{}
-	for scraper, enabled := range scraperFlags {
+	for name, enabled := range scraperFlags {
 		if *enabled {
-			log.WithFields(log.Fields{"scraper": scraper.Name()}).Info("Scraper Enabled")
-			enabledScrapers = append(enabledScrapers, scraper)
+			log.WithFields(log.Fields{"scraper": name}).Info("Scraper Enabled")
 		}
 	}
 
-	handlerFunc := newHandler(collector.NewMetrics(), enabledScrapers)
+	targets := &targetSet{}
+	r := &reloader{file: *configFile, scraperFlags: scraperFlags, targets: targets}
+	if err := r.reload(); err != nil {
+		os.Exit(1)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			r.reload()
+		}
+	}()
+
 	log.WithFields(log.Fields{"metricPath": *metricPath}).Debug("handler for metricPath")
 	// http.Handle(*metricPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handlerFunc))
-	http.Handle(*metricPath, handlerFunc)
+	http.Handle(*metricPath, newHandler(targets))
+	http.Handle(*probePath, newProbeHandler(targets))
+	http.Handle("/status", newStatusHandler(targets))
+	http.Handle("/-/reload", r)
+	http.Handle(queriesPath, newQueriesHandler(targets))
+	http.Handle(deadlocksPath, newDeadlocksHandler(targets))
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(landingPage)
@@ -99,57 +151,22 @@ func main() {
 
 	log.WithFields(log.Fields{"address": *listenAddress}).Info("Listening on address")
 	srv := &http.Server{Addr: *listenAddress}
-	if err := srv.ListenAndServe(); err != nil {
+	if err := web.ListenAndServe(srv, *webConfigFile); err != nil {
 		log.WithFields(log.Fields{"err": err}).Error("Error starting HTTP server")
 		os.Exit(1)
 	}
 }
 
-func newHandler(metrics collector.Metrics, scrapers []collector.Scraper) http.HandlerFunc {
+// newHandler serves the default target on the metrics path together with the exporter's own metrics.
+func newHandler(targets *targetSet) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		filteredScrapers := scrapers
-		params := r.URL.Query()["collect[]"]
-		// Use request context for cancellation when connection gets closed.
-		ctx := r.Context()
-		// If a timeout is configured via the Prometheus header, add it to the context.
-		if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
-			timeoutSeconds, err := strconv.ParseFloat(v, 64)
-			if err != nil {
-				log.WithFields(log.Fields{"error": err}).Error("Failed to parse timeout from Prometheus header")
-			} else {
-				if *timeoutOffset >= timeoutSeconds {
-					// Ignore timeout offset if it doesn't leave time to scrape.
-					log.WithFields(log.Fields{"offset": *timeoutOffset, "prometheus_scrape_timeout": timeoutSeconds}).Error("Timeout offset should be lower than prometheus scrape timeout")
-				} else {
-					// Subtract timeout offset from timeout.
-					timeoutSeconds -= *timeoutOffset
-				}
-				// Create new timeout context with request context as parent.
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutSeconds*float64(time.Second)))
-				defer cancel()
-				// Overwrite request with timeout context.
-				r = r.WithContext(ctx)
-			}
-		}
-
-		// Check if we have some "collect[]" query parameters.
-		if len(params) > 0 {
-			filters := make(map[string]bool)
-			for _, param := range params {
-				filters[param] = true
-			}
-
-			filteredScrapers = nil
-			for _, scraper := range scrapers {
-				if filters[scraper.Name()] {
-					filteredScrapers = append(filteredScrapers, scraper)
-				}
-			}
-		}
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
 
 		registry := prometheus.NewRegistry()
-		registry.MustRegister(collector.New(ctx, filteredScrapers, *configFile))
+		if t, ok := targets.get(config.DefaultTargetName); ok {
+			registry.MustRegister(collector.New(ctx, t, t.FilterScrapers(r.URL.Query()["collect[]"])))
+		}
 
 		gatherers := prometheus.Gatherers{
 			prometheus.DefaultGatherer,
@@ -160,3 +177,170 @@ func newHandler(metrics collector.Metrics, scrapers []collector.Scraper) http.Ha
 		h.ServeHTTP(w, r)
 	}
 }
+
+// newProbeHandler serves the target given by the "target" parameter, in the style of blackbox_exporter.
+// Every metric is labeled with the target name.
+func newProbeHandler(targets *targetSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("target")
+		if name == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		t, ok := targets.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+			return
+		}
+
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		registry := prometheus.NewRegistry()
+		registerer := prometheus.WrapRegistererWith(prometheus.Labels{"target": t.Name}, registry)
+		registerer.MustRegister(collector.New(ctx, t, t.FilterScrapers(r.URL.Query()["collect[]"])))
+
+		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+		h.ServeHTTP(w, r)
+	}
+}
+
+const queriesPath = "/api/v1/queries/"
+
+// newQueriesHandler serves the text, database and plan hashes of a statement tracked by
+// the SQL statistics collector as JSON, on /api/v1/queries/<query_hash>?target=<name>.
+// The default target is used when the target parameter is missing.
+func newQueriesHandler(targets *targetSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimPrefix(r.URL.Path, queriesPath)
+		if hash == "" || strings.Contains(hash, "/") {
+			http.Error(w, "query hash is missing", http.StatusBadRequest)
+			return
+		}
+
+		name := r.URL.Query().Get("target")
+		if name == "" {
+			name = config.DefaultTargetName
+		}
+		t, ok := targets.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+			return
+		}
+
+		queries, ok := t.Queries(hash)
+		if !ok {
+			http.Error(w, fmt.Sprintf("collector mssql_sql_stat is not enabled for target %q", name), http.StatusNotFound)
+			return
+		}
+		if len(queries) == 0 {
+			http.Error(w, fmt.Sprintf("unknown query hash %q", hash), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(queries)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Encode queries")
+		}
+	}
+}
+
+const deadlocksPath = "/api/v1/deadlocks"
+
+// newDeadlocksHandler serves the archived deadlock graphs of a target as JSON, the most recent first.
+func newDeadlocksHandler(targets *targetSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("target")
+		if name == "" {
+			name = config.DefaultTargetName
+		}
+		t, ok := targets.get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+			return
+		}
+
+		deadlocks, ok := t.Deadlocks()
+		if !ok {
+			http.Error(w, fmt.Sprintf("collector mssql_deadlock is not enabled for target %q", name), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(deadlocks)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Encode deadlocks")
+		}
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+<head><title>SQL Server Database exporter status</title></head>
+<body>
+<h1>SQL Server Database exporter status</h1>
+{{range .}}
+<h2>{{.Name}}</h2>
+<table border="1" cellpadding="4">
+<tr><th>Collector</th><th>Last Run</th><th>Duration</th><th>Success</th><th>Skipped</th><th>Last Error</th><th>Last Error Time</th></tr>
+{{range .Collectors}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if not .LastRun.IsZero}}{{.LastRun.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Success}}</td>
+<td>{{.SkipReason}}</td>
+<td>{{.LastError}}</td>
+<td>{{if not .LastErrorTime.IsZero}}{{.LastErrorTime.Format "2006-01-02 15:04:05"}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// newStatusHandler serves the status of the last run of every collector of every target.
+func newStatusHandler(targets *targetSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type targetStatus struct {
+			Name       string
+			Collectors []collector.CollectorStatus
+		}
+
+		var data []targetStatus
+		for _, t := range targets.sorted() {
+			data = append(data, targetStatus{Name: t.Name, Collectors: t.Status()})
+		}
+
+		err := statusTemplate.Execute(w, data)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Render status page")
+		}
+	}
+}
+
+// scrapeContext returns the request context, limited by the timeout from the Prometheus header if set.
+// Use request context for cancellation when connection gets closed.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := r.Context()
+	// If a timeout is configured via the Prometheus header, add it to the context.
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		timeoutSeconds, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to parse timeout from Prometheus header")
+		} else {
+			if *timeoutOffset >= timeoutSeconds {
+				// Ignore timeout offset if it doesn't leave time to scrape.
+				log.WithFields(log.Fields{"offset": *timeoutOffset, "prometheus_scrape_timeout": timeoutSeconds}).Error("Timeout offset should be lower than prometheus scrape timeout")
+			} else {
+				// Subtract timeout offset from timeout.
+				timeoutSeconds -= *timeoutOffset
+			}
+			// Create new timeout context with request context as parent.
+			return context.WithTimeout(ctx, time.Duration(timeoutSeconds*float64(time.Second)))
+		}
+	}
+	return context.WithCancel(ctx)
+}
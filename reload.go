@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"yunche.pro/dtsre/mssql_exporter/collector"
+	"yunche.pro/dtsre/mssql_exporter/config"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mssql",
+		Subsystem: "exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mssql",
+		Subsystem: "exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+}
+
+// targetSet holds the targets of the current config.
+type targetSet struct {
+	mu      sync.RWMutex
+	targets map[string]*collector.Target
+}
+
+func (ts *targetSet) get(name string) (*collector.Target, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	t, ok := ts.targets[name]
+	return t, ok
+}
+
+// sorted returns the targets sorted by name.
+func (ts *targetSet) sorted() []*collector.Target {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	var result []*collector.Target
+	for _, t := range ts.targets {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// reloader loads the config file and applies it to the running targets.
+type reloader struct {
+	file         string
+	scraperFlags map[string]*bool
+	targets      *targetSet
+
+	mu sync.Mutex
+}
+
+// reload loads the config file and applies it. A config with errors is not applied at all,
+// the targets keep running with the previous config.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.apply()
+	if err != nil {
+		configReloadSuccess.Set(0)
+		log.WithFields(log.Fields{"err": err, "file": r.file}).Error("Error reloading config file")
+		return err
+	}
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	log.WithFields(log.Fields{"file": r.file}).Info("Config Loaded")
+	return nil
+}
+
+func (r *reloader) apply() error {
+	cfg, err := config.Load(r.file)
+	if err != nil {
+		return err
+	}
+
+	r.targets.mu.RLock()
+	current := r.targets.targets
+	r.targets.mu.RUnlock()
+
+	// create all scrapers before touching a target, so an error leaves everything unchanged
+	scrapers := make(map[string][]collector.Scraper)
+	for _, t := range cfg.Targets {
+		var existing []collector.Scraper
+		if old, ok := current[t.Name]; ok {
+			existing = old.Scrapers()
+		}
+		scrapers[t.Name], err = targetScrapers(t, cfg, r.scraperFlags, existing)
+		if err != nil {
+			return fmt.Errorf("target %q: %w", t.Name, err)
+		}
+	}
+
+	// targets are updated at once, each one waits for its running scrapes to be cancelled
+	var wg sync.WaitGroup
+	targets := make(map[string]*collector.Target)
+	for _, t := range cfg.Targets {
+		if old, ok := current[t.Name]; ok {
+			wg.Add(1)
+			go func(t config.Target, old *collector.Target) {
+				defer wg.Done()
+				old.Update(t.MSSQLConfig, scrapers[t.Name], cfg.CollectorSettings)
+				log.WithFields(log.Fields{"target": t.Name, "scrapers": len(scrapers[t.Name])}).Info("Target Updated")
+			}(t, old)
+			targets[t.Name] = old
+			continue
+		}
+
+		target := collector.NewTarget(t.Name, t.MSSQLConfig, scrapers[t.Name], cfg.CollectorSettings)
+		target.Start()
+		targets[t.Name] = target
+		log.WithFields(log.Fields{"target": t.Name, "scrapers": len(scrapers[t.Name])}).Info("Target Added")
+	}
+
+	r.targets.mu.Lock()
+	r.targets.targets = targets
+	r.targets.mu.Unlock()
+
+	for name, old := range current {
+		if _, ok := targets[name]; !ok {
+			wg.Add(1)
+			go func(name string, old *collector.Target) {
+				defer wg.Done()
+				old.Close()
+				log.WithFields(log.Fields{"target": name}).Info("Target Removed")
+			}(name, old)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// ServeHTTP reloads the config on POST /-/reload.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// targetScrapers returns the scrapers listed in the target config, or the scrapers enabled
+// by flags and collector settings and all enabled custom queries when the target does not list any.
+// Built-in scrapers of existing are reused to keep their state.
+func targetScrapers(t config.Target, cfg *config.Config, scraperFlags map[string]*bool, existing []collector.Scraper) ([]collector.Scraper, error) {
+	all := make(map[string]collector.Scraper)
+	for scraper := range newScrapers() {
+		all[scraper.Name()] = scraper
+	}
+	for _, scraper := range existing {
+		if _, ok := all[scraper.Name()]; ok {
+			all[scraper.Name()] = scraper
+		}
+	}
+
+	enabled := make(map[string]bool)
+	for name, f := range scraperFlags {
+		enabled[name] = *f
+	}
+
+	var custom []string
+	for _, q := range cfg.Queries {
+		if _, ok := all[q.Name]; ok {
+			return nil, fmt.Errorf("query %q has the name of a built-in collector", q.Name)
+		}
+		all[q.Name] = collector.NewScrapeCustomQuery(q)
+		enabled[q.Name] = true
+		custom = append(custom, q.Name)
+	}
+
+	for name, settings := range cfg.CollectorSettings {
+		if _, ok := all[name]; !ok {
+			return nil, fmt.Errorf("settings of unknown collector %q", name)
+		}
+		if settings.Enabled != nil {
+			enabled[name] = *settings.Enabled
+		}
+	}
+
+	var result []collector.Scraper
+	if len(t.Collectors) == 0 {
+		for name := range scraperFlags {
+			if enabled[name] {
+				result = append(result, all[name])
+			}
+		}
+		for _, name := range custom {
+			if enabled[name] {
+				result = append(result, all[name])
+			}
+		}
+		return result, nil
+	}
+
+	for _, name := range t.Collectors {
+		scraper, ok := all[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		result = append(result, scraper)
+	}
+	return result, nil
+}
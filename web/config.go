@@ -0,0 +1,189 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the web config file, in the format of the Prometheus exporter-toolkit.
+//
+//	tls_server_config:
+//	  cert_file: server.crt
+//	  key_file: server.key
+//	  client_auth_type: RequireAndVerifyClientCert
+//	  client_ca_file: ca.crt
+//	basic_auth_users:
+//	  prometheus: $2y$10$...
+type Config struct {
+	TLSConfig TLSConfig `yaml:"tls_server_config"`
+	// Users maps user names to bcrypt hashed passwords.
+	Users map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSConfig configures HTTPS, relative file names are relative to the config file.
+type TLSConfig struct {
+	CertFile         string   `yaml:"cert_file"`
+	KeyFile          string   `yaml:"key_file"`
+	ClientAuth       string   `yaml:"client_auth_type"`
+	ClientCAs        string   `yaml:"client_ca_file"`
+	MinVersion       string   `yaml:"min_version"`
+	MaxVersion       string   `yaml:"max_version"`
+	CipherSuites     []string `yaml:"cipher_suites"`
+	CurvePreferences []string `yaml:"curve_preferences"`
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS13": tls.VersionTLS13,
+		"TLS12": tls.VersionTLS12,
+		"TLS11": tls.VersionTLS11,
+		"TLS10": tls.VersionTLS10,
+	}
+
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+
+	curves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+)
+
+// LoadConfig reads and validates the web config file, the certificates are loaded by TLSConfig.build.
+func LoadConfig(file string) (*Config, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	err = yaml.UnmarshalStrict(buf, c)
+	if err != nil {
+		return nil, err
+	}
+	c.TLSConfig.setDirectory(filepath.Dir(file))
+
+	for user, hash := range c.Users {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("basic_auth_users: invalid bcrypt hash of user %q: %w", user, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *TLSConfig) setDirectory(dir string) {
+	for _, f := range []*string{&c.CertFile, &c.KeyFile, &c.ClientCAs} {
+		if *f != "" && !filepath.IsAbs(*f) {
+			*f = filepath.Join(dir, *f)
+		}
+	}
+}
+
+// files returns the certificate files of c.
+func (c *TLSConfig) files() []string {
+	var result []string
+	for _, f := range []string{c.CertFile, c.KeyFile, c.ClientCAs} {
+		if f != "" {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// build returns the tls.Config, loading the certificates from disk.
+func (c *TLSConfig) build() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file must both be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if c.MaxVersion != "" {
+		v, ok := tlsVersions[c.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown max_version %q", c.MaxVersion)
+		}
+		cfg.MaxVersion = v
+	}
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < cfg.MinVersion {
+		return nil, fmt.Errorf("max_version is lower than min_version")
+	}
+
+	if len(c.CipherSuites) > 0 {
+		ids := make(map[string]uint16)
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			ids[s.Name] = s.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	for _, name := range c.CurvePreferences {
+		id, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	clientAuth, ok := clientAuthTypes[c.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", c.ClientAuth)
+	}
+	cfg.ClientAuth = clientAuth
+
+	if c.ClientCAs != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("read client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client_ca_file %s", c.ClientCAs)
+		}
+		cfg.ClientCAs = pool
+	}
+	if (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("client_ca_file is required for client_auth_type %s", c.ClientAuth)
+	}
+	return cfg, nil
+}
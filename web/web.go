@@ -0,0 +1,190 @@
+// Package web serves the exporter over HTTPS and with basic auth as configured by a web
+// config file in the format of the Prometheus exporter-toolkit.
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// dummyHash is compared for unknown users, so they take as long to reject as wrong passwords.
+	dummyHash = "$2a$10$VcMj1l.7vNCaOjaan2ZsfeuJDGaq5dNo7pOJgOZiGZt9NzIrqZfKO"
+
+	authCacheSize = 100
+)
+
+// ListenAndServe serves srv as configured by configFile, plain HTTP without authentication
+// when configFile is empty.
+//
+// The config and the certificates are loaded again when the modification time of the config
+// file or of a certificate file changes, so rotated certificates and changed users are used
+// without a restart. Whether TLS is used is decided at start.
+// When the files become invalid the last valid config is kept.
+func ListenAndServe(srv *http.Server, configFile string) error {
+	if configFile == "" {
+		return srv.ListenAndServe()
+	}
+
+	l := &loader{file: configFile}
+	err := l.reload(l.stamp(nil))
+	if err != nil {
+		return err
+	}
+
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv.Handler = &authHandler{loader: l, handler: handler, cache: make(map[[sha256.Size]byte]bool)}
+
+	if l.tls == nil {
+		log.WithFields(log.Fields{"file": configFile}).Info("TLS is disabled")
+		return srv.ListenAndServe()
+	}
+
+	log.WithFields(log.Fields{"file": configFile}).Info("TLS is enabled")
+	srv.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, cfg := l.load()
+			return cfg, nil
+		},
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// loader keeps the last valid config and the TLS config built from it.
+type loader struct {
+	file string
+
+	mu    sync.Mutex
+	files string
+	c     *Config
+	tls   *tls.Config
+}
+
+// load returns the config, reloading it when the config file or a certificate file changed.
+// The TLS config is nil when TLS is disabled.
+func (l *loader) load() (*Config, *tls.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files := l.stamp(l.c)
+	if files != l.files {
+		err := l.reload(files)
+		if err != nil {
+			log.WithFields(log.Fields{"file": l.file, "error": err}).Error("Reload web config failed, keep the last valid config")
+		} else {
+			log.WithFields(log.Fields{"file": l.file}).Info("Web config reloaded")
+		}
+	}
+	return l.c, l.tls
+}
+
+// reload loads the config file and the certificates, files is the stamp of the files
+// before loading. An invalid config is not loaded again until files change.
+func (l *loader) reload(files string) error {
+	l.files = files
+
+	c, err := LoadConfig(l.file)
+	if err != nil {
+		return err
+	}
+
+	var cfg *tls.Config
+	if c.TLSConfig.enabled() {
+		cfg, err = c.TLSConfig.build()
+		if err != nil {
+			return fmt.Errorf("tls_server_config: %w", err)
+		}
+	}
+	if l.c != nil && (cfg == nil) != (l.tls == nil) {
+		return fmt.Errorf("tls_server_config: enabling or disabling TLS requires a restart")
+	}
+
+	l.c = c
+	l.tls = cfg
+	l.files = l.stamp(c)
+	return nil
+}
+
+// stamp returns the modification times and sizes of the config file and the certificate files of c.
+func (l *loader) stamp(c *Config) string {
+	files := []string{l.file}
+	if c != nil {
+		files = append(files, c.TLSConfig.files()...)
+	}
+
+	var b strings.Builder
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:-;", f)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", f, info.ModTime().UnixNano(), info.Size())
+	}
+	return b.String()
+}
+
+// authHandler requires basic auth when users are configured.
+type authHandler struct {
+	loader  *loader
+	handler http.Handler
+
+	// cache of bcrypt comparisons, which are slow by design
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]bool
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, _ := h.loader.load()
+	if len(c.Users) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	user, password, ok := r.BasicAuth()
+	if ok {
+		hash, known := c.Users[user]
+		if !known {
+			hash = dummyHash
+		}
+		if h.check(user, password, hash) && known {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="mssql_exporter"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (h *authHandler) check(user, password, hash string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	h.mu.Lock()
+	valid, ok := h.cache[key]
+	h.mu.Unlock()
+	if ok {
+		return valid
+	}
+
+	valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	h.mu.Lock()
+	if len(h.cache) >= authCacheSize {
+		h.cache = make(map[[sha256.Size]byte]bool)
+	}
+	h.cache[key] = valid
+	h.mu.Unlock()
+	return valid
+}